@@ -5,7 +5,21 @@ go 1.16
 require (
 	github.com/gofiber/fiber/v2 v2.9.0
 	github.com/gofiber/websocket/v2 v2.0.3
+	github.com/pion/ice/v2 v2.0.16
+	github.com/pion/interceptor v0.0.12
 	github.com/pion/rtcp v1.2.6
+	github.com/pion/rtp v1.6.2
+	github.com/pion/sdp/v3 v3.0.4
+	github.com/pion/stun v0.3.5
 	github.com/pion/turn/v2 v2.0.5
 	github.com/pion/webrtc/v3 v3.0.20
+	github.com/prometheus/client_golang v1.11.1
+	github.com/sirupsen/logrus v1.8.1
+	github.com/valyala/fasthttp v1.23.0
+	go.opentelemetry.io/otel v1.3.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.3.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.3.0
+	go.opentelemetry.io/otel/sdk v1.3.0
+	go.opentelemetry.io/otel/trace v1.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,489 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"webrtc-streaming/pkg/turnserver"
+	w "webrtc-streaming/pkg/webrtc"
+)
+
+// Config is every setting the server reads at startup. It is loaded from an
+// optional YAML file, then overridden by environment variables, then validated.
+type Config struct {
+	Environment string          `yaml:"environment"` // development | production
+	Server      ServerConfig    `yaml:"server"`
+	ICE         ICEConfig       `yaml:"ice"`
+	TURN        TURNConfig      `yaml:"turn"`
+	Timeouts    TimeoutsConfig  `yaml:"timeouts"`
+	WebSocket   WebSocketConfig `yaml:"websocket"`
+	Storage     StorageConfig   `yaml:"storage"`
+	Auth        AuthConfig      `yaml:"auth"`
+	Codecs      w.CodecPolicy   `yaml:"codecs"`
+	Log         LogConfig       `yaml:"log"`
+	Tracing     TracingConfig   `yaml:"tracing"`
+}
+
+type ServerConfig struct {
+	ListenAddr string `yaml:"listenAddr"`
+	// PublicBaseURL is how clients reach the server, e.g. https://duress.example.com.
+	// When empty, WebSocket URLs are built from the request's host.
+	PublicBaseURL string    `yaml:"publicBaseUrl"`
+	TLS           TLSConfig `yaml:"tls"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+type ICEConfig struct {
+	Servers []ICEServer `yaml:"servers"`
+	// TransportPolicy is "all" or "relay" (TURN only)
+	TransportPolicy string `yaml:"transportPolicy"`
+	// RestartAttempts is how many ICE restarts the SFU tries before closing
+	// a failed PeerConnection
+	RestartAttempts int `yaml:"restartAttempts"`
+}
+
+// ICEServer is one STUN or TURN server. URLs may mix stun:, turn: and turns:
+// with ?transport=udp|tcp.
+type ICEServer struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username"`
+	Credential string   `yaml:"credential"`
+	// CredentialType is "password" (default) or "oauth"; for oauth the
+	// credential is the access token and MACKey its key
+	CredentialType string `yaml:"credentialType"`
+	MACKey         string `yaml:"macKey"`
+}
+
+// TURNConfig enables time-limited TURN credentials minted per user with a
+// secret shared with the TURN server (tools/turn --auth-secret)
+type TURNConfig struct {
+	Secret string        `yaml:"secret"`
+	TTL    time.Duration `yaml:"ttl"`
+	// URLs handed out with minted credentials, e.g. turn:turn.example.com:3478
+	URLs []string `yaml:"urls"`
+	// Embedded runs the TURN server inside this process instead
+	Embedded EmbeddedTURNConfig `yaml:"embedded"`
+}
+
+// EmbeddedTURNConfig is the in-process TURN server. It always uses the secret
+// above (generated when empty) and, without urls, advertises its own listeners.
+type EmbeddedTURNConfig struct {
+	Enabled           bool `yaml:"enabled"`
+	turnserver.Config `yaml:",inline"`
+}
+
+type TimeoutsConfig struct {
+	Read  time.Duration `yaml:"read"`
+	Write time.Duration `yaml:"write"`
+	Idle  time.Duration `yaml:"idle"`
+}
+
+// WebSocketConfig is the heartbeat on signaling sockets: pings every
+// PingInterval, and a socket silent for ReadTimeout counts as disconnected
+type WebSocketConfig struct {
+	PingInterval time.Duration `yaml:"pingInterval"`
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	// ResumeGrace is how long a dropped broadcaster may resume its session
+	ResumeGrace time.Duration `yaml:"resumeGrace"`
+}
+
+type StorageConfig struct {
+	// Driver holds help requests and rooms; only "memory" exists today
+	Driver string `yaml:"driver"`
+}
+
+type AuthConfig struct {
+	// OperatorToken protects /stats and /metrics when set (Bearer token)
+	OperatorToken string `yaml:"operatorToken"`
+}
+
+// LogConfig is the format and level of the server's logs
+type LogConfig struct {
+	Format string `yaml:"format"` // logfmt or json
+	Level  string `yaml:"level"`  // debug, info, warn or error
+	// Redact masks mobile numbers and SDP bodies
+	Redact bool `yaml:"redact"`
+}
+
+// TracingConfig picks the OpenTelemetry exporter. otlp is configured by the
+// standard OTEL_EXPORTER_OTLP_* variables.
+type TracingConfig struct {
+	Exporter string `yaml:"exporter"` // none, otlp or stdout
+}
+
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+)
+
+// Default is the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		Environment: EnvDevelopment,
+		Server: ServerConfig{
+			ListenAddr: ":8080",
+		},
+		ICE: ICEConfig{
+			TransportPolicy: "all",
+			RestartAttempts: 3,
+		},
+		TURN: TURNConfig{
+			TTL:      6 * time.Hour,
+			Embedded: EmbeddedTURNConfig{Config: turnserver.Default()},
+		},
+		Timeouts: TimeoutsConfig{
+			Read:  30 * time.Second,
+			Write: 30 * time.Second,
+			Idle:  120 * time.Second,
+		},
+		WebSocket: WebSocketConfig{
+			PingInterval: 15 * time.Second,
+			ReadTimeout:  45 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			ResumeGrace:  30 * time.Second,
+		},
+		Storage: StorageConfig{Driver: "memory"},
+		Codecs:  w.DefaultCodecPolicy(),
+		Log: LogConfig{
+			Format: "logfmt",
+			Level:  "info",
+			Redact: true,
+		},
+		Tracing: TracingConfig{Exporter: "none"},
+	}
+}
+
+// Load reads path (if not empty), applies environment overrides and validates
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config: %v", err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parse %s: %v", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.prepareEmbeddedTURN(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Environment variables override the file. PORT and ENVIRONMENT keep their old meaning.
+func (c *Config) applyEnv() error {
+	if v := os.Getenv("ENVIRONMENT"); v != "" {
+		c.Environment = strings.ToLower(v)
+	}
+	if v := os.Getenv("PORT"); v != "" {
+		c.Server.ListenAddr = ":" + v
+	}
+	if v := os.Getenv("LISTEN_ADDR"); v != "" {
+		c.Server.ListenAddr = v
+	}
+	if v := os.Getenv("PUBLIC_BASE_URL"); v != "" {
+		c.Server.PublicBaseURL = v
+	}
+	if v := os.Getenv("TLS_CERT_FILE"); v != "" {
+		c.Server.TLS.CertFile = v
+	}
+	if v := os.Getenv("TLS_KEY_FILE"); v != "" {
+		c.Server.TLS.KeyFile = v
+	}
+	if v := os.Getenv("ICE_TRANSPORT_POLICY"); v != "" {
+		c.ICE.TransportPolicy = v
+	}
+	if v := os.Getenv("ICE_RESTART_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("ICE_RESTART_ATTEMPTS: %v", err)
+		}
+		c.ICE.RestartAttempts = n
+	}
+	if v := os.Getenv("ICE_SERVERS"); v != "" {
+		// A YAML or JSON list in the same shape as ice.servers
+		var servers []ICEServer
+		if err := yaml.Unmarshal([]byte(v), &servers); err != nil {
+			return fmt.Errorf("ICE_SERVERS: %v", err)
+		}
+		c.ICE.Servers = servers
+	}
+	if v := os.Getenv("TURN_SECRET"); v != "" {
+		c.TURN.Secret = v
+	}
+	if v := os.Getenv("TURN_URLS"); v != "" {
+		c.TURN.URLs = strings.Split(v, ",")
+	}
+	if v := os.Getenv("TURN_EMBED"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("TURN_EMBED: %v", err)
+		}
+		c.TURN.Embedded.Enabled = enabled
+	}
+	if v := os.Getenv("TURN_PUBLIC_IP"); v != "" {
+		c.TURN.Embedded.Relays = []turnserver.Relay{{PublicIP: v}}
+	}
+	if v := os.Getenv("STORAGE_DRIVER"); v != "" {
+		c.Storage.Driver = v
+	}
+	if v := os.Getenv("OPERATOR_TOKEN"); v != "" {
+		c.Auth.OperatorToken = v
+	}
+	if v := os.Getenv("VIDEO_CODECS"); v != "" {
+		c.Codecs.Video = nil
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				c.Codecs.Video = append(c.Codecs.Video, name)
+			}
+		}
+	}
+	if v := os.Getenv("H264_PROFILE_LEVEL_ID"); v != "" {
+		c.Codecs.H264ProfileLevelID = v
+	}
+	if v := os.Getenv("OPUS_MAX_BITRATE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("OPUS_MAX_BITRATE: %v", err)
+		}
+		c.Codecs.Opus.MaxAverageBitrate = n
+	}
+	if v := os.Getenv("LOG_FORMAT"); v != "" {
+		c.Log.Format = v
+	}
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		c.Log.Level = v
+	}
+	if v := os.Getenv("TRACING_EXPORTER"); v != "" {
+		c.Tracing.Exporter = v
+	}
+
+	for env, target := range map[string]*bool{
+		"OPUS_STEREO":                 &c.Codecs.Opus.Stereo,
+		"OPUS_FEC":                    &c.Codecs.Opus.InbandFEC,
+		"OPUS_DTX":                    &c.Codecs.Opus.DTX,
+		"REJECT_INCOMPATIBLE_VIEWERS": &c.Codecs.RejectIncompatibleViewers,
+		"LOG_REDACT":                  &c.Log.Redact,
+	} {
+		v := os.Getenv(env)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", env, err)
+		}
+		*target = b
+	}
+
+	for env, target := range map[string]*time.Duration{
+		"READ_TIMEOUT":     &c.Timeouts.Read,
+		"WRITE_TIMEOUT":    &c.Timeouts.Write,
+		"IDLE_TIMEOUT":     &c.Timeouts.Idle,
+		"TURN_TTL":         &c.TURN.TTL,
+		"WS_PING_INTERVAL": &c.WebSocket.PingInterval,
+		"WS_READ_TIMEOUT":  &c.WebSocket.ReadTimeout,
+		"WS_WRITE_TIMEOUT": &c.WebSocket.WriteTimeout,
+		"WS_RESUME_GRACE":  &c.WebSocket.ResumeGrace,
+	} {
+		v := os.Getenv(env)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", env, err)
+		}
+		*target = d
+	}
+	return nil
+}
+
+// Validate reports the first setting that cannot work
+func (c *Config) Validate() error {
+	switch c.Environment {
+	case EnvDevelopment, EnvProduction:
+	default:
+		return fmt.Errorf("environment: %q is not development or production", c.Environment)
+	}
+
+	if _, port, err := net.SplitHostPort(c.Server.ListenAddr); err != nil {
+		return fmt.Errorf("server.listenAddr: %v", err)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("server.listenAddr: invalid port %q", port)
+	}
+
+	if c.Server.PublicBaseURL != "" {
+		u, err := url.Parse(c.Server.PublicBaseURL)
+		if err != nil {
+			return fmt.Errorf("server.publicBaseUrl: %v", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("server.publicBaseUrl: %q must be an absolute http(s) URL", c.Server.PublicBaseURL)
+		}
+	}
+
+	tls := c.Server.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		return fmt.Errorf("server.tls: certFile and keyFile must be set together")
+	}
+	for _, f := range []string{tls.CertFile, tls.KeyFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("server.tls: %v", err)
+		}
+	}
+
+	if c.TURN.Embedded.Enabled {
+		if err := c.TURN.Embedded.Validate(); err != nil {
+			return fmt.Errorf("turn.embedded.%v", err)
+		}
+	}
+	if c.TURN.Secret != "" {
+		if len(c.TURN.URLs) == 0 {
+			return fmt.Errorf("turn.urls: needed when turn.secret is set")
+		}
+		if c.TURN.TTL < time.Minute {
+			return fmt.Errorf("turn.ttl: %v is shorter than a minute", c.TURN.TTL)
+		}
+	}
+	if err := c.ICEFor("validate", time.Now()).validate(); err != nil {
+		return err
+	}
+	if c.ICE.RestartAttempts < 0 {
+		return fmt.Errorf("ice.restartAttempts: must not be negative")
+	}
+
+	for name, d := range map[string]time.Duration{
+		"timeouts.read":          c.Timeouts.Read,
+		"timeouts.write":         c.Timeouts.Write,
+		"timeouts.idle":          c.Timeouts.Idle,
+		"websocket.pingInterval": c.WebSocket.PingInterval,
+		"websocket.readTimeout":  c.WebSocket.ReadTimeout,
+		"websocket.writeTimeout": c.WebSocket.WriteTimeout,
+		"websocket.resumeGrace":  c.WebSocket.ResumeGrace,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s: must not be negative", name)
+		}
+	}
+
+	// Pings must land before the read deadline or live clients are dropped
+	if c.WebSocket.ReadTimeout > 0 && c.WebSocket.PingInterval >= c.WebSocket.ReadTimeout {
+		return fmt.Errorf("websocket.pingInterval: %v must be shorter than readTimeout %v", c.WebSocket.PingInterval, c.WebSocket.ReadTimeout)
+	}
+
+	if c.Storage.Driver != "memory" {
+		return fmt.Errorf("storage.driver: %q is not supported (only memory)", c.Storage.Driver)
+	}
+
+	if len(c.Codecs.Video) == 0 {
+		return fmt.Errorf("codecs.video: at least one codec is required")
+	}
+	for _, name := range c.Codecs.Video {
+		switch strings.ToUpper(name) {
+		case "H264", "VP8", "VP9":
+		default:
+			return fmt.Errorf("codecs.video: %q is not H264, VP8 or VP9", name)
+		}
+	}
+	if _, err := hex.DecodeString(c.Codecs.H264ProfileLevelID); err != nil || len(c.Codecs.H264ProfileLevelID) != 6 {
+		return fmt.Errorf("codecs.h264ProfileLevelId: %q is not 6 hex digits", c.Codecs.H264ProfileLevelID)
+	}
+	if c.Codecs.Opus.MaxAverageBitrate < 0 {
+		return fmt.Errorf("codecs.opus.maxBitrate: must not be negative")
+	}
+
+	switch c.Log.Format {
+	case "logfmt", "text", "json":
+	default:
+		return fmt.Errorf("log.format: %q is not logfmt or json", c.Log.Format)
+	}
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("log.level: %v", err)
+	}
+	switch c.Tracing.Exporter {
+	case "none", "otlp", "stdout":
+	default:
+		return fmt.Errorf("tracing.exporter: %q is not none, otlp or stdout", c.Tracing.Exporter)
+	}
+	return nil
+}
+
+// The embedded TURN server shares the minting secret, so a random one is
+// enough when none is configured, and advertises itself unless urls are set
+func (c *Config) prepareEmbeddedTURN() error {
+	if !c.TURN.Embedded.Enabled {
+		return nil
+	}
+	if c.TURN.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return fmt.Errorf("turn.secret: %v", err)
+		}
+		c.TURN.Secret = hex.EncodeToString(secret)
+	}
+	c.TURN.Embedded.Auth = turnserver.Auth{Mode: "secret", Secret: c.TURN.Secret}
+	if len(c.TURN.URLs) == 0 {
+		// turns: URLs need the certificate's name, taken from the public URL
+		var tlsHost string
+		if u, err := url.Parse(c.Server.PublicBaseURL); err == nil {
+			tlsHost = u.Hostname()
+		}
+		c.TURN.URLs = c.TURN.Embedded.URLs(tlsHost)
+	}
+	return nil
+}
+
+// Production reports whether the server runs in the production environment
+func (c *Config) Production() bool {
+	return c.Environment == EnvProduction
+}
+
+// TLSEnabled reports whether the server terminates TLS itself
+func (c *Config) TLSEnabled() bool {
+	return c.Server.TLS.CertFile != ""
+}
+
+// WebSocketBase is the ws:// or wss:// origin clients connect to. host is the
+// request's host, used when no public base URL is configured.
+func (c *Config) WebSocketBase(host string) string {
+	if c.Server.PublicBaseURL != "" {
+		u, _ := url.Parse(c.Server.PublicBaseURL)
+		scheme := "ws"
+		if u.Scheme == "https" {
+			scheme = "wss"
+		}
+		return scheme + "://" + u.Host + strings.TrimSuffix(u.Path, "/")
+	}
+	scheme := "ws"
+	if c.Production() || c.TLSEnabled() {
+		scheme = "wss"
+	}
+	return scheme + "://" + host
+}
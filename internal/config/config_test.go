@@ -0,0 +1,184 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Variables Load reads that a test sets; cleared first so the caller's
+// environment cannot leak in
+var testEnv = []string{
+	"ENVIRONMENT", "PORT", "LISTEN_ADDR", "VIDEO_CODECS", "H264_PROFILE_LEVEL_ID",
+	"OPUS_FEC", "LOG_FORMAT", "LOG_LEVEL", "LOG_REDACT", "TRACING_EXPORTER",
+	"WS_PING_INTERVAL", "WS_READ_TIMEOUT",
+}
+
+func setenv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, key := range testEnv {
+		old, had := os.LookupEnv(key)
+		if err := os.Unsetenv(key); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if had {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+	for key, value := range env {
+		if err := os.Setenv(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testYAML = `
+server:
+  listenAddr: ":9000"
+websocket:
+  pingInterval: 5s
+codecs:
+  video: [VP8, H264]
+  opus:
+    fec: false
+log:
+  format: json
+  level: debug
+  redact: false
+tracing:
+  exporter: stdout
+`
+
+func TestLoadDefaults(t *testing.T) {
+	setenv(t, nil)
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("Load(\"\") = %+v, want the defaults", cfg)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	setenv(t, nil)
+	cfg, err := Load(writeConfig(t, testYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Server.ListenAddr != ":9000" {
+		t.Errorf("listenAddr %q", cfg.Server.ListenAddr)
+	}
+	if cfg.WebSocket.PingInterval != 5*time.Second {
+		t.Errorf("pingInterval %v", cfg.WebSocket.PingInterval)
+	}
+	if want := []string{"VP8", "H264"}; !reflect.DeepEqual(cfg.Codecs.Video, want) {
+		t.Errorf("codecs.video %v, want %v", cfg.Codecs.Video, want)
+	}
+	if cfg.Codecs.Opus.InbandFEC {
+		t.Error("codecs.opus.fec still on")
+	}
+	if (cfg.Log != LogConfig{Format: "json", Level: "debug", Redact: false}) {
+		t.Errorf("log %+v", cfg.Log)
+	}
+	if cfg.Tracing.Exporter != "stdout" {
+		t.Errorf("tracing.exporter %q", cfg.Tracing.Exporter)
+	}
+
+	// Whatever the file leaves out keeps its default
+	def := Default()
+	if cfg.WebSocket.ReadTimeout != def.WebSocket.ReadTimeout {
+		t.Errorf("readTimeout %v, want the default %v", cfg.WebSocket.ReadTimeout, def.WebSocket.ReadTimeout)
+	}
+	if cfg.Codecs.H264ProfileLevelID != def.Codecs.H264ProfileLevelID {
+		t.Errorf("h264ProfileLevelId %q, want the default", cfg.Codecs.H264ProfileLevelID)
+	}
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	setenv(t, map[string]string{
+		"PORT":             "9100",
+		"VIDEO_CODECS":     " vp9 , ",
+		"OPUS_FEC":         "true",
+		"LOG_LEVEL":        "warn",
+		"LOG_REDACT":       "1",
+		"TRACING_EXPORTER": "none",
+	})
+	cfg, err := Load(writeConfig(t, testYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Server.ListenAddr != ":9100" {
+		t.Errorf("listenAddr %q", cfg.Server.ListenAddr)
+	}
+	if want := []string{"vp9"}; !reflect.DeepEqual(cfg.Codecs.Video, want) {
+		t.Errorf("codecs.video %v, want %v", cfg.Codecs.Video, want)
+	}
+	if !cfg.Codecs.Opus.InbandFEC {
+		t.Error("OPUS_FEC ignored")
+	}
+	if (cfg.Log != LogConfig{Format: "json", Level: "warn", Redact: true}) {
+		t.Errorf("log %+v", cfg.Log)
+	}
+	if cfg.Tracing.Exporter != "none" {
+		t.Errorf("tracing.exporter %q", cfg.Tracing.Exporter)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  map[string]string
+	}{
+		{"unknown environment", "environment: staging", nil},
+		{"bad port", `server: {listenAddr: ":99999"}`, nil},
+		{"codec from file", "codecs: {video: [AV1]}", nil},
+		{"codec from env", "", map[string]string{"VIDEO_CODECS": "AV1"}},
+		{"no codecs", "codecs: {video: []}", nil},
+		{"bad profile", "codecs: {h264ProfileLevelId: 42e0}", nil},
+		{"log format", "log: {format: xml}", nil},
+		{"log level", "", map[string]string{"LOG_LEVEL": "loud"}},
+		{"log redact", "", map[string]string{"LOG_REDACT": "maybe"}},
+		{"exporter", "tracing: {exporter: jaeger}", nil},
+		{"ping after read timeout", "", map[string]string{"WS_PING_INTERVAL": "1m", "WS_READ_TIMEOUT": "30s"}},
+		{"bad duration", "", map[string]string{"WS_READ_TIMEOUT": "soon"}},
+		{"not yaml", "server: [", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, tt.env)
+			path := ""
+			if tt.yaml != "" {
+				path = writeConfig(t, tt.yaml)
+			}
+			if cfg, err := Load(path); err == nil {
+				t.Errorf("accepted: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	setenv(t, nil)
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file accepted")
+	}
+}
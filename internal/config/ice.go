@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+	"webrtc-streaming/pkg/turncred"
+)
+
+func (c ICEConfig) validate() error {
+	switch c.TransportPolicy {
+	case "all", "relay":
+	default:
+		return fmt.Errorf("ice.transportPolicy: %q is not all or relay", c.TransportPolicy)
+	}
+
+	haveTURN := false
+	for i, s := range c.Servers {
+		if len(s.URLs) == 0 {
+			return fmt.Errorf("ice.servers[%d]: no urls", i)
+		}
+		switch s.CredentialType {
+		case "", "password":
+		case "oauth":
+			if s.MACKey == "" {
+				return fmt.Errorf("ice.servers[%d]: oauth credentials need macKey", i)
+			}
+		default:
+			return fmt.Errorf("ice.servers[%d]: credentialType %q is not password or oauth", i, s.CredentialType)
+		}
+		for _, raw := range s.URLs {
+			u, err := ice.ParseURL(raw)
+			if err != nil {
+				return fmt.Errorf("ice.servers[%d]: %q: %v", i, raw, err)
+			}
+			if u.Scheme == ice.SchemeTypeTURN || u.Scheme == ice.SchemeTypeTURNS {
+				if s.Username == "" || s.Credential == "" {
+					return fmt.Errorf("ice.servers[%d]: %q needs username and credential", i, raw)
+				}
+				haveTURN = true
+			}
+		}
+	}
+
+	if c.TransportPolicy == "relay" && !haveTURN {
+		return fmt.Errorf("ice.transportPolicy: relay needs at least one turn: or turns: URL in ice.servers")
+	}
+	return nil
+}
+
+// ICEFor returns the configured ICE servers plus, when a TURN secret is set,
+// the TURN URLs with credentials minted for userID
+func (c *Config) ICEFor(userID string, now time.Time) ICEConfig {
+	ice := ICEConfig{
+		Servers:         append([]ICEServer(nil), c.ICE.Servers...),
+		TransportPolicy: c.ICE.TransportPolicy,
+	}
+	if c.TURN.Secret != "" {
+		cred := turncred.Mint(c.TURN.Secret, userID, c.TURN.TTL, now)
+		ice.Servers = append(ice.Servers, ICEServer{
+			URLs:       c.TURN.URLs,
+			Username:   cred.Username,
+			Credential: cred.Password,
+		})
+	}
+	return ice
+}
+
+// WithoutTURN drops turn: and turns: URLs, and servers left with none, so
+// no relay credentials are handed out
+func (c ICEConfig) WithoutTURN() ICEConfig {
+	out := ICEConfig{TransportPolicy: c.TransportPolicy}
+	for _, s := range c.Servers {
+		var urls []string
+		for _, raw := range s.URLs {
+			u, err := ice.ParseURL(raw)
+			if err != nil || u.Scheme == ice.SchemeTypeTURN || u.Scheme == ice.SchemeTypeTURNS {
+				continue
+			}
+			urls = append(urls, raw)
+		}
+		if len(urls) > 0 {
+			out.Servers = append(out.Servers, ICEServer{URLs: urls})
+		}
+	}
+	return out
+}
+
+// RTCConfiguration is the PeerConnection configuration for these settings
+func (c ICEConfig) RTCConfiguration() webrtc.Configuration {
+	rtc := webrtc.Configuration{ICETransportPolicy: webrtc.ICETransportPolicyAll}
+	if c.TransportPolicy == "relay" {
+		rtc.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+	for _, s := range c.Servers {
+		server := webrtc.ICEServer{URLs: s.URLs}
+		if s.Username != "" {
+			server.Username = s.Username
+			server.Credential = s.Credential
+			server.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		if s.CredentialType == "oauth" {
+			server.Credential = webrtc.OAuthCredential{MACKey: s.MACKey, AccessToken: s.Credential}
+			server.CredentialType = webrtc.ICECredentialTypeOauth
+		}
+		rtc.ICEServers = append(rtc.ICEServers, server)
+	}
+	return rtc
+}
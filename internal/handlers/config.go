@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"crypto/subtle"
+
+	"github.com/gofiber/fiber/v2"
+	"webrtc-streaming/internal/config"
+)
+
+// Server configuration, injected once at startup
+var cfg = config.Default()
+
+// Configure hands the loaded configuration to the handlers
+func Configure(c *config.Config) {
+	cfg = c
+}
+
+// Absolute WebSocket URL for path as seen by the client
+func wsURL(c *fiber.Ctx, path string) string {
+	return cfg.WebSocketBase(c.Hostname()) + path
+}
+
+// RequireOperator guards operator endpoints with the configured bearer token, if any
+func RequireOperator(c *fiber.Ctx) error {
+	token := cfg.Auth.OperatorToken
+	if token == "" {
+		return c.Next()
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Get(fiber.HeaderAuthorization)), []byte("Bearer "+token)) != 1 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	return c.Next()
+}
@@ -1,26 +1,36 @@
 package handlers
 
 import (
-	"encoding/json"
-	"log"
 	"sync"
+	"time"
 
 	"github.com/gofiber/websocket/v2"
+	"webrtc-streaming/pkg/logging"
+	"webrtc-streaming/pkg/signaling"
+	w "webrtc-streaming/pkg/webrtc"
 )
 
-// Minimal message both sides understand.
-type wsMessage struct {
-	Event  string `json:"event"`
-	Data   string `json:"data"`
-	RoomID string `json:"roomId,omitempty"`
-}
+// Minimal message both sides understand; each socket's codec turns it into
+// that client's protocol version
+type wsMessage = signaling.Message
+
+// Broadcaster candidates kept for viewers that join after the offer
+const maxCachedCandidates = 64
 
-// room socket pair + last offer
+// room socket pair + last offer and the candidates that followed it
 type roomSockets struct {
 	mu          sync.RWMutex
-	broadcaster *websocket.Conn
-	viewer      *websocket.Conn
+	broadcaster *w.ThreadSafeWriter
+	viewer      *w.ThreadSafeWriter
 	lastOffer   *wsMessage // cache the most recent offer
+	candidates  []wsMessage
+
+	// Broadcaster resumption (see resume.go)
+	resumeToken string
+	resumeUntil time.Time
+
+	// Who is connected, by role (see presence.go)
+	present map[string]signaling.Participant
 }
 
 var (
@@ -39,49 +49,121 @@ func getRoomSockets(roomID string) *roomSockets {
 	return rs
 }
 
+// Send a server event to the socket holding role, if connected
+func (rs *roomSockets) notify(role, event, data string) {
+	rs.send(role, wsMessage{Event: event, Data: data})
+}
+
+func (rs *roomSockets) send(role string, m wsMessage) {
+	rs.mu.RLock()
+	conn := rs.viewer
+	if role == "broadcaster" {
+		conn = rs.broadcaster
+	}
+	rs.mu.RUnlock()
+	if conn != nil {
+		_ = conn.Send(m)
+	}
+}
+
+// Close a socket that lost its role to a newer connection. The old one may
+// be half-dead, so the close frame is best effort.
+func closeReplaced(ws *w.ThreadSafeWriter) {
+	_ = ws.Close(signaling.CloseReplaced, "replaced by a newer connection")
+	_ = ws.Conn.Close()
+}
+
+// Whether a help request handed out roomID
+func knownRoom(roomID string) bool {
+	helpLock.RLock()
+	defer helpLock.RUnlock()
+	for _, rid := range nameToRoom {
+		if rid == roomID {
+			return true
+		}
+	}
+	return false
+}
+
 // Victim WS
 func DuressWebSocket(c *websocket.Conn) {
 	roomID := c.Params("roomId")
+	logger := wsLogger(c, roomID).WithField(logging.Role, "broadcaster")
 	if roomID == "" {
-		log.Println("DuressWebSocket: missing roomId")
+		logger.Warn("DuressWebSocket: missing roomId")
 		return
 	}
 	rs := getRoomSockets(roomID)
-
-	rs.mu.Lock()
-	if rs.broadcaster != nil {
-		_ = rs.broadcaster.Close()
+	ws := w.NewWriter(c)
+	resumed, token, replaced := rs.attachBroadcaster(ws, c.Query("resume"))
+	if replaced != nil {
+		closeReplaced(replaced)
 	}
-	rs.broadcaster = c
-	rs.mu.Unlock()
+	me := signaling.Participant{Role: "broadcaster", Name: participantName(c, roomID, "broadcaster")}
 
-	log.Printf("Broadcaster connected to room: %s\n", roomID)
+	ctx, span := startRoomSpan(roomID, "broadcaster websocket")
+	defer span.End()
+
+	_ = ws.Send(wsMessage{Event: "resume-token", Data: token})
+	if resumed {
+		logger.Info("Broadcaster resumed session")
+		rs.notify("viewer", "peer-reconnected", "broadcaster")
+		// The old network path is gone; the victim offers again with an ICE restart
+		_ = ws.Send(wsMessage{Event: "ice-restart"})
+	} else {
+		logger.Info("Broadcaster connected")
+	}
+	rs.join(me)
 	defer func() {
-		rs.mu.Lock()
-		if rs.broadcaster == c {
-			rs.broadcaster = nil
+		if rs.detachBroadcaster(ws, cfg.WebSocket.ResumeGrace, logger) {
+			rs.notify("viewer", "peer-disconnected", "broadcaster")
+			rs.leave(me)
 		}
-		rs.mu.Unlock()
 		_ = c.Close()
-		log.Printf("Broadcaster disconnected for room: %s\n", roomID)
+		logger.Info("Broadcaster disconnected")
 	}()
 
+	hb := w.StartHeartbeat(c)
+	defer hb.Stop()
 	for {
 		_, raw, err := c.ReadMessage()
 		if err != nil {
-			log.Printf("Broadcaster read error: %v\n", err)
+			if w.HeartbeatMissed(err, "broadcaster") {
+				logger.Warn("Broadcaster missed heartbeat; disconnecting")
+				_ = ws.Close(signaling.CloseGoingAway, "heartbeat missed")
+				return
+			}
+			logger.WithError(err).Info("Broadcaster WS closed")
 			return
 		}
-		var msg wsMessage
-		if err := json.Unmarshal(raw, &msg); err != nil {
-			msg = wsMessage{Event: "unknown", Data: string(raw)}
+		hb.Alive()
+		// Frames that fail validation are answered, not relayed
+		msg, verr := ws.Codec.Decode(raw)
+		if verr != nil {
+			logger.WithError(verr).Warn("Rejected broadcaster message")
+			_ = ws.Send(verr.Event())
+			continue
+		}
+		if msg.Event == "heartbeat" {
+			_ = ws.Send(wsMessage{Event: "heartbeat-ack", Data: msg.Data})
+			continue
 		}
 
-		// Cache the latest OFFER so late viewers can receive it immediately
-		if msg.Event == "offer" {
+		// Cache the latest OFFER and the broadcaster's candidates so late
+		// viewers can receive them immediately
+		switch msg.Event {
+		case "offer":
 			rs.mu.Lock()
 			copy := msg
 			rs.lastOffer = &copy
+			// Candidates of the previous offer belong to a dead ICE session
+			rs.candidates = nil
+			rs.mu.Unlock()
+		case "candidate":
+			rs.mu.Lock()
+			if len(rs.candidates) < maxCachedCandidates {
+				rs.candidates = append(rs.candidates, msg)
+			}
 			rs.mu.Unlock()
 		}
 
@@ -89,66 +171,119 @@ func DuressWebSocket(c *websocket.Conn) {
 		v := rs.viewer
 		rs.mu.RUnlock()
 		if v == nil {
+			// The offer and candidates wait in the cache; the victim knows from
+			// the roster that nobody is listening
+			logger.WithField("event", msg.Event).Debug("No viewer connected; not relayed")
 			continue
 		}
-		if err := v.WriteJSON(msg); err != nil {
-			log.Printf("Relay to viewer failed: %v\n", err)
+		err = v.Send(msg)
+		traceRelay(ctx, msg.Event, "viewer", err)
+		if err != nil {
+			logger.WithError(err).WithField("event", msg.Event).Warn("Relay to viewer failed")
+			relayFailures.WithLabelValues("viewer").Inc()
+			continue
 		}
+		relayedMessages.WithLabelValues(relayEventLabel(msg.Event)).Inc()
 	}
 }
 
 // Helper WS
 func DuressViewerWebSocket(c *websocket.Conn) {
 	roomID := c.Params("roomId")
+	logger := wsLogger(c, roomID).WithField(logging.Role, "viewer")
 	if roomID == "" {
-		log.Println("DuressViewerWebSocket: missing roomId")
+		logger.Warn("DuressViewerWebSocket: missing roomId")
+		return
+	}
+	ws := w.NewWriter(c)
+	// Helpers only learn room IDs from a help request
+	if !knownRoom(roomID) {
+		logger.Warn("DuressViewerWebSocket: room not found")
+		ws.Fail(signaling.NewError(signaling.CodeRoomNotFound, "", "room %s not found", roomID), signaling.CloseRoomNotFound)
 		return
 	}
 	rs := getRoomSockets(roomID)
 
 	rs.mu.Lock()
-	if rs.viewer != nil {
-		_ = rs.viewer.Close()
-	}
-	rs.viewer = c
-	// snapshot any cached offer
+	replaced := rs.viewer
+	rs.viewer = ws
+	// snapshot any cached offer and candidates
 	cachedOffer := rs.lastOffer
+	cachedCandidates := append([]wsMessage(nil), rs.candidates...)
 	rs.mu.Unlock()
+	// Closing waits on the old socket, so it happens outside the lock
+	if replaced != nil {
+		closeReplaced(replaced)
+	}
+	me := signaling.Participant{Role: "viewer", Name: participantName(c, roomID, "viewer")}
+
+	ctx, span := startRoomSpan(roomID, "viewer websocket")
+	defer span.End()
 
-	log.Printf("Viewer connected to room: %s\n", roomID)
+	logger.Info("Viewer connected")
+	rs.join(me)
 	defer func() {
 		rs.mu.Lock()
-		if rs.viewer == c {
+		current := rs.viewer == ws
+		if current {
 			rs.viewer = nil
 		}
 		rs.mu.Unlock()
+		if current {
+			rs.leave(me)
+		}
 		_ = c.Close()
-		log.Printf("Viewer disconnected for room: %s\n", roomID)
+		logger.Info("Viewer disconnected")
 	}()
 
-	// Immediately push the cached OFFER if we have one
+	// Immediately push the cached OFFER if we have one, then its candidates
 	if cachedOffer != nil {
-		_ = c.WriteJSON(cachedOffer)
+		traceRelay(ctx, cachedOffer.Event, "viewer", ws.Send(*cachedOffer))
+	}
+	for _, cand := range cachedCandidates {
+		traceRelay(ctx, cand.Event, "viewer", ws.Send(cand))
 	}
 
+	hb := w.StartHeartbeat(c)
+	defer hb.Stop()
 	for {
 		_, raw, err := c.ReadMessage()
 		if err != nil {
-			log.Printf("Viewer read error: %v\n", err)
+			if w.HeartbeatMissed(err, "viewer") {
+				logger.Warn("Viewer missed heartbeat; disconnecting")
+				_ = ws.Close(signaling.CloseGoingAway, "heartbeat missed")
+				rs.notify("broadcaster", "peer-disconnected", "viewer")
+				return
+			}
+			logger.WithError(err).Info("Viewer WS closed")
 			return
 		}
-		var msg wsMessage
-		if err := json.Unmarshal(raw, &msg); err != nil {
-			msg = wsMessage{Event: "unknown", Data: string(raw)}
+		hb.Alive()
+		// Frames that fail validation are answered, not relayed
+		msg, verr := ws.Codec.Decode(raw)
+		if verr != nil {
+			logger.WithError(verr).Warn("Rejected viewer message")
+			_ = ws.Send(verr.Event())
+			continue
+		}
+		if msg.Event == "heartbeat" {
+			_ = ws.Send(wsMessage{Event: "heartbeat-ack", Data: msg.Data})
+			continue
 		}
 		rs.mu.RLock()
 		bc := rs.broadcaster
 		rs.mu.RUnlock()
 		if bc == nil {
+			logger.WithField("event", msg.Event).Debug("No broadcaster connected; not relayed")
 			continue
 		}
-		if err := bc.WriteJSON(msg); err != nil {
-			log.Printf("Relay to broadcaster failed: %v\n", err)
+		err = bc.Send(msg)
+		traceRelay(ctx, msg.Event, "broadcaster", err)
+		if err != nil {
+			logger.WithError(err).WithField("event", msg.Event).Warn("Relay to broadcaster failed")
+			relayFailures.WithLabelValues("broadcaster").Inc()
+			continue
 		}
+		relayedMessages.WithLabelValues(relayEventLabel(msg.Event)).Inc()
 	}
 }
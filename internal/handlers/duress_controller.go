@@ -2,11 +2,11 @@ package handlers
 
 import (
 	"fmt"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
 )
 
 type HelpRequest struct {
@@ -21,8 +21,18 @@ var (
 	helpRequests         []HelpRequest
 	helpAcknowledgements = make(map[string]string) // requester -> helper
 	nameToRoom           = make(map[string]string) // requester -> roomId
+	iceTokens            = make(map[string]string) // "<roomId>-<role>" -> token for /ice-servers
 )
 
+// The /ice-servers token for one role in a room, minted on first use
+func iceToken(roomID, role string) string {
+	user := roomID + "-" + role
+	if iceTokens[user] == "" {
+		iceTokens[user] = newToken()
+	}
+	return iceTokens[user]
+}
+
 func StartHelpSession(c *fiber.Ctx) error {
 	var req HelpRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -61,10 +71,10 @@ func StartHelpSession(c *fiber.Ctx) error {
 		}
 	}
 
-	scheme := "ws"
-	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
-		scheme = "wss"
-	}
+	startSessionSpan(rid, req.Zone)
+	_, span := startRoomSpan(rid, "StartHelpSession")
+	defer span.End()
+	httpLogger(c, rid).WithFields(logrus.Fields{"zone": req.Zone, "mobile": req.Mobile}).Info("Help session started")
 
 	return c.JSON(fiber.Map{
 		"status":    "success",
@@ -75,8 +85,10 @@ func StartHelpSession(c *fiber.Ctx) error {
 			"zone":   req.Zone,
 			"mobile": req.Mobile,
 		},
-		"broadcasterWs":      fmt.Sprintf("%s://%s/duress/%s/websocket", scheme, c.Hostname(), rid),
-		"viewerWebsocketUrl": fmt.Sprintf("%s://%s/duress/%s/viewer/websocket", scheme, c.Hostname(), rid),
+		"broadcasterWs":      wsURL(c, "/duress/"+rid+"/websocket"),
+		"viewerWebsocketUrl": wsURL(c, "/duress/"+rid+"/viewer/websocket"),
+		"ice":                iceServersFor(rid + "-victim"),
+		"iceToken":           iceToken(rid, "victim"),
 	})
 }
 
@@ -84,10 +96,6 @@ func DuressListen(c *fiber.Ctx) error {
 	helpLock.RLock()
 	defer helpLock.RUnlock()
 
-	scheme := "ws"
-	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
-		scheme = "wss"
-	}
 	for i := len(helpRequests) - 1; i >= 0; i-- {
 		r := helpRequests[i]
 		if r.Status == "open" {
@@ -100,8 +108,8 @@ func DuressListen(c *fiber.Ctx) error {
 			}
 			if rid != "" {
 				resp["roomId"]             = rid
-				resp["viewerWebsocketUrl"] = fmt.Sprintf("%s://%s/duress/%s/viewer/websocket", scheme, c.Hostname(), rid)
-				resp["broadcasterWs"]      = fmt.Sprintf("%s://%s/duress/%s/websocket", scheme, c.Hostname(), rid)
+				resp["viewerWebsocketUrl"] = wsURL(c, "/duress/"+rid+"/viewer/websocket")
+				resp["broadcasterWs"]      = wsURL(c, "/duress/"+rid+"/websocket")
 			}
 			return c.JSON(resp)
 		}
@@ -119,6 +127,11 @@ func GiveHelp(c *fiber.Ctx) error {
 	helpLock.Lock()
 	defer helpLock.Unlock()
 
+	rid := nameToRoom[requester]
+	_, span := startRoomSpan(rid, "GiveHelp")
+	defer span.End()
+	httpLogger(c, rid).Info("Helper assigned")
+
 	helpAcknowledgements[requester] = helper
 	for i := range helpRequests {
 		if helpRequests[i].Name == requester {
@@ -126,7 +139,16 @@ func GiveHelp(c *fiber.Ctx) error {
 			break
 		}
 	}
-	return c.JSON(fiber.Map{"status": "success"})
+	resp := fiber.Map{"status": "success"}
+	// Helper credentials only for a requester that has a room; a new helper
+	// gets a new token, so the previous one can no longer fetch TURN credentials
+	if rid != "" {
+		delete(iceTokens, rid+"-helper")
+		resp["roomId"] = rid
+		resp["ice"] = iceServersFor(rid + "-helper")
+		resp["iceToken"] = iceToken(rid, "helper")
+	}
+	return c.JSON(resp)
 }
 
 func ListenForHelper(c *fiber.Ctx) error {
@@ -143,10 +165,6 @@ func ListenForHelper(c *fiber.Ctx) error {
 		return c.JSON(nil)
 	}
 
-	scheme := "ws"
-	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
-		scheme = "wss"
-	}
 	rid := nameToRoom[requester]
 
 	status := "open"
@@ -161,8 +179,8 @@ func ListenForHelper(c *fiber.Ctx) error {
 		"helper":             helper,
 		"status":             status,
 		"roomId":             rid,
-		"viewerWebsocketUrl": fmt.Sprintf("%s://%s/duress/%s/viewer/websocket", scheme, c.Hostname(), rid),
-		"broadcasterWs":      fmt.Sprintf("%s://%s/duress/%s/websocket", scheme, c.Hostname(), rid),
+		"viewerWebsocketUrl": wsURL(c, "/duress/"+rid+"/viewer/websocket"),
+		"broadcasterWs":      wsURL(c, "/duress/"+rid+"/websocket"),
 	})
 }
 
@@ -176,13 +194,22 @@ func HelpCompleted(c *fiber.Ctx) error {
 	helpLock.Lock()
 	defer helpLock.Unlock()
 
+	rid := nameToRoom[requester]
+	_, span := startRoomSpan(rid, "HelpCompleted")
+	httpLogger(c, rid).Info("Help session completed")
+
 	delete(helpAcknowledgements, requester)
+	delete(iceTokens, rid+"-victim")
+	delete(iceTokens, rid+"-helper")
 	for i := range helpRequests {
 		if helpRequests[i].Name == requester {
 			helpRequests[i].Status = "closed"
 			break
 		}
 	}
+
+	span.End()
+	endSessionSpan(rid)
 	return c.JSON(fiber.Map{"status": "success"})
 }
 
@@ -199,14 +226,9 @@ func SessionInfo(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "Not found"})
 	}
 
-	scheme := "ws"
-	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
-		scheme = "wss"
-	}
-
 	return c.JSON(fiber.Map{
 		"roomId":             rid,
-		"viewerWebsocketUrl": fmt.Sprintf("%s://%s/duress/%s/viewer/websocket", scheme, c.Hostname(), rid),
-		"broadcasterWs":      fmt.Sprintf("%s://%s/duress/%s/websocket", scheme, c.Hostname(), rid),
+		"viewerWebsocketUrl": wsURL(c, "/duress/"+rid+"/viewer/websocket"),
+		"broadcasterWs":      wsURL(c, "/duress/"+rid+"/websocket"),
 	})
 }
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"webrtc-streaming/internal/config"
+)
+
+// RTCIceServer as a browser or libwebrtc client expects it
+type clientICEServer struct {
+	URLs           []string    `json:"urls"`
+	Username       string      `json:"username,omitempty"`
+	Credential     interface{} `json:"credential,omitempty"`
+	CredentialType string      `json:"credentialType,omitempty"`
+}
+
+// GET /ice-servers?roomId=<roomId>&role=victim|helper&token=<iceToken>
+// The ICE servers and transport policy the server's own PeerConnections use,
+// shaped as an RTCConfiguration so clients can pass it straight through.
+// TURN is only included, with credentials for "<roomId>-<role>", for the
+// iceToken help or give_help handed to that role; anyone else gets STUN only.
+func ICEServers(c *fiber.Ctx) error {
+	roomID, role := c.Query("roomId"), c.Query("role")
+	if (role == "victim" || role == "helper") && roomID != "" && validICEToken(roomID+"-"+role, c.Query("token")) {
+		return c.JSON(iceServersFor(roomID + "-" + role))
+	}
+	return c.JSON(clientICEConfig(cfg.ICE.WithoutTURN()))
+}
+
+// Whether token is the one issued for user, e.g. "<roomId>-victim"
+func validICEToken(user, token string) bool {
+	helpLock.RLock()
+	want := iceTokens[user]
+	helpLock.RUnlock()
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// Servers and policy for one user, e.g. "<roomId>-victim" in a help session
+func iceServersFor(userID string) fiber.Map {
+	return clientICEConfig(cfg.ICEFor(userID, time.Now()))
+}
+
+func clientICEConfig(ice config.ICEConfig) fiber.Map {
+	servers := make([]clientICEServer, 0, len(ice.Servers))
+	for _, s := range ice.Servers {
+		server := clientICEServer{URLs: s.URLs}
+		if s.Username != "" {
+			server.Username = s.Username
+			server.Credential = s.Credential
+			server.CredentialType = "password"
+		}
+		if s.CredentialType == "oauth" {
+			server.Credential = fiber.Map{"macKey": s.MACKey, "accessToken": s.Credential}
+			server.CredentialType = "oauth"
+		}
+		servers = append(servers, server)
+	}
+
+	return fiber.Map{
+		"iceServers":         servers,
+		"iceTransportPolicy": ice.TransportPolicy,
+	}
+}
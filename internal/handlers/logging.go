@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/sirupsen/logrus"
+	"webrtc-streaming/pkg/logging"
+)
+
+// Entry for an HTTP request, tagged with its request ID and room if known
+func httpLogger(c *fiber.Ctx, roomID string) *logrus.Entry {
+	return requestLogger(c.Locals("requestid"), roomID)
+}
+
+// Entry for a WebSocket, tagged with the upgrade request's ID and the room
+func wsLogger(c *websocket.Conn, roomID string) *logrus.Entry {
+	return requestLogger(c.Locals("requestid"), roomID)
+}
+
+func requestLogger(requestID interface{}, roomID string) *logrus.Entry {
+	fields := logrus.Fields{}
+	if id, ok := requestID.(string); ok && id != "" {
+		fields[logging.RequestID] = id
+	}
+	if roomID != "" {
+		fields[logging.RoomID] = roomID
+	}
+	return logging.Logger.WithFields(fields)
+}
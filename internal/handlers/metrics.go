@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// Signaling metrics, registered with the default Prometheus registry
+var (
+	relayedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "duress_ws_messages_relayed_total",
+		Help: "WebSocket messages relayed between victim and helper, by event type.",
+	}, []string{"event"})
+
+	relayFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "duress_relay_failures_total",
+		Help: "WebSocket relay writes that failed, by destination role.",
+	}, []string{"to"})
+)
+
+// Event labels are limited to the known signaling events so clients cannot
+// create unbounded series
+var relayedEvents = map[string]bool{
+	"offer":             true,
+	"answer":            true,
+	"candidate":         true,
+	"duress-alert":      true,
+	"duress-stop":       true,
+	"ice-restart":       true,
+	"end-of-candidates": true,
+	"bye":               true,
+}
+
+func relayEventLabel(event string) string {
+	if relayedEvents[event] {
+		return event
+	}
+	return "other"
+}
+
+func init() {
+	prometheus.MustRegister(duressCollector{
+		requests:     prometheus.NewDesc("duress_help_requests", "Help requests by status.", []string{"status"}, nil),
+		rooms:        prometheus.NewDesc("duress_rooms_active", "Relay rooms with a victim or helper connected.", nil, nil),
+		broadcasters: prometheus.NewDesc("duress_broadcasters_connected", "Victim WebSockets connected.", nil, nil),
+		viewers:      prometheus.NewDesc("duress_viewers_connected", "Helper WebSockets connected.", nil, nil),
+	})
+}
+
+// duressCollector reads help requests and relay sockets at scrape time
+type duressCollector struct {
+	requests     *prometheus.Desc
+	rooms        *prometheus.Desc
+	broadcasters *prometheus.Desc
+	viewers      *prometheus.Desc
+}
+
+func (c duressCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.requests
+	ch <- c.rooms
+	ch <- c.broadcasters
+	ch <- c.viewers
+}
+
+func (c duressCollector) Collect(ch chan<- prometheus.Metric) {
+	statuses := map[string]int{"open": 0, "taken": 0, "closed": 0}
+	helpLock.RLock()
+	for _, r := range helpRequests {
+		statuses[r.Status]++
+	}
+	helpLock.RUnlock()
+	for status, n := range statuses {
+		ch <- prometheus.MustNewConstMetric(c.requests, prometheus.GaugeValue, float64(n), status)
+	}
+
+	roomsMu.RLock()
+	all := make([]*roomSockets, 0, len(socketByID))
+	for _, rs := range socketByID {
+		all = append(all, rs)
+	}
+	roomsMu.RUnlock()
+
+	var rooms, broadcasters, viewers int
+	for _, rs := range all {
+		rs.mu.RLock()
+		if rs.broadcaster != nil {
+			broadcasters++
+		}
+		if rs.viewer != nil {
+			viewers++
+		}
+		if rs.broadcaster != nil || rs.viewer != nil {
+			rooms++
+		}
+		rs.mu.RUnlock()
+	}
+	ch <- prometheus.MustNewConstMetric(c.rooms, prometheus.GaugeValue, float64(rooms))
+	ch <- prometheus.MustNewConstMetric(c.broadcasters, prometheus.GaugeValue, float64(broadcasters))
+	ch <- prometheus.MustNewConstMetric(c.viewers, prometheus.GaugeValue, float64(viewers))
+}
+
+var metricsHandler = fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+
+// GET /metrics
+// Prometheus exposition of server and SFU metrics
+func Metrics(c *fiber.Ctx) error {
+	metricsHandler(c.Context())
+	return nil
+}
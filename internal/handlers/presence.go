@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"github.com/gofiber/websocket/v2"
+	"webrtc-streaming/pkg/signaling"
+)
+
+// Relay room presence: when one side connects the other gets
+// participant-joined and the newcomer a roster of who is already there;
+// participant-left follows when a side drops for good or into the resume
+// window. A socket replaced by a newer one for the same role leaves silently.
+
+// Display name for role in roomID: ?name= on the socket, else the victim's
+// name from the help request or the helper assigned to it
+func participantName(c *websocket.Conn, roomID, role string) string {
+	if name := c.Query("name"); name != "" {
+		return name
+	}
+	helpLock.RLock()
+	defer helpLock.RUnlock()
+	for requester, rid := range nameToRoom {
+		if rid != roomID {
+			continue
+		}
+		if role == "broadcaster" {
+			return requester
+		}
+		return helpAcknowledgements[requester]
+	}
+	return ""
+}
+
+func otherRole(role string) string {
+	if role == "broadcaster" {
+		return "viewer"
+	}
+	return "broadcaster"
+}
+
+// Record p as present, send it the roster and announce it to the other side
+func (rs *roomSockets) join(p signaling.Participant) {
+	rs.mu.Lock()
+	if rs.present == nil {
+		rs.present = map[string]signaling.Participant{}
+	}
+	rs.present[p.Role] = p
+	var others []signaling.Participant
+	if other, ok := rs.present[otherRole(p.Role)]; ok {
+		others = append(others, other)
+	}
+	rs.mu.Unlock()
+
+	rs.send(p.Role, signaling.Roster(others))
+	rs.send(otherRole(p.Role), signaling.Joined(p))
+}
+
+// Forget p and tell the other side
+func (rs *roomSockets) leave(p signaling.Participant) {
+	rs.mu.Lock()
+	delete(rs.present, p.Role)
+	rs.mu.Unlock()
+
+	rs.send(otherRole(p.Role), signaling.Left(p))
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	w "webrtc-streaming/pkg/webrtc"
+)
+
+// Broadcaster session resumption: a victim whose socket drops (Wi-Fi to
+// cellular, say) reconnects with ?resume=<token> within websocket.resumeGrace
+// and keeps the room, instead of starting over as a new broadcaster.
+
+// A random, unguessable token for resumption or ICE credentials
+func newToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Take the broadcaster slot for ws, resuming the previous session if token
+// is still valid. Returns the token the client should keep for next time and
+// the socket ws replaced, which the caller closes once rs.mu is released.
+func (rs *roomSockets) attachBroadcaster(ws *w.ThreadSafeWriter, token string) (resumed bool, issued string, replaced *w.ThreadSafeWriter) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	// The old socket may not have noticed it is dead yet
+	live := rs.broadcaster != nil || time.Now().Before(rs.resumeUntil)
+	resumed = live && token != "" && rs.resumeToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(rs.resumeToken)) == 1
+
+	replaced = rs.broadcaster
+	rs.broadcaster = ws
+	rs.resumeUntil = time.Time{}
+	// Either way ICE starts over, so the old candidates are stale
+	rs.candidates = nil
+	if !resumed {
+		// A new session; the cached offer belonged to the old PeerConnection
+		rs.lastOffer = nil
+		rs.resumeToken = newToken()
+	}
+	return resumed, rs.resumeToken, replaced
+}
+
+// Give up the broadcaster slot and open the resume window. Reports false if
+// ws had already been replaced by a newer socket.
+func (rs *roomSockets) detachBroadcaster(ws *w.ThreadSafeWriter, grace time.Duration, logger *logrus.Entry) bool {
+	rs.mu.Lock()
+	if rs.broadcaster != ws {
+		rs.mu.Unlock()
+		return false
+	}
+	rs.broadcaster = nil
+	until := time.Now().Add(grace)
+	rs.resumeUntil = until
+	rs.mu.Unlock()
+
+	time.AfterFunc(grace, func() {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		if rs.broadcaster != nil || !rs.resumeUntil.Equal(until) {
+			return
+		}
+		rs.resumeToken = ""
+		rs.resumeUntil = time.Time{}
+		rs.lastOffer = nil
+		rs.candidates = nil
+		logger.Info("Broadcaster resume window expired")
+	})
+	return true
+}
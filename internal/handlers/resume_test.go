@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"webrtc-streaming/pkg/logging"
+	w "webrtc-streaming/pkg/webrtc"
+)
+
+func TestAttachReplacesBroadcaster(t *testing.T) {
+	rs := &roomSockets{}
+	first, second := &w.ThreadSafeWriter{}, &w.ThreadSafeWriter{}
+
+	resumed, token, replaced := rs.attachBroadcaster(first, "")
+	if resumed || token == "" || replaced != nil {
+		t.Fatalf("first attach = %v, %q, %v", resumed, token, replaced)
+	}
+	rs.lastOffer = &wsMessage{Event: "offer", Data: "sdp"}
+	rs.candidates = []wsMessage{{Event: "candidate"}}
+
+	// A reconnect with the token takes over the live session
+	resumed, again, replaced := rs.attachBroadcaster(second, token)
+	if !resumed || again != token {
+		t.Errorf("resume = %v, %q; want true, %q", resumed, again, token)
+	}
+	if replaced != first {
+		t.Error("the old socket was not handed back to close")
+	}
+	if rs.broadcaster != second {
+		t.Error("the new socket does not hold the slot")
+	}
+	if rs.lastOffer == nil {
+		t.Error("resuming dropped the cached offer")
+	}
+	if rs.candidates != nil {
+		t.Error("resuming kept the old candidates")
+	}
+
+	// Without the token it is a new session
+	third := &w.ThreadSafeWriter{}
+	resumed, fresh, replaced := rs.attachBroadcaster(third, "wrong")
+	if resumed || fresh == token || replaced != second {
+		t.Errorf("attach with a wrong token = %v, %q, %v", resumed, fresh, replaced)
+	}
+	if rs.lastOffer != nil {
+		t.Error("a new session kept the old offer")
+	}
+}
+
+func TestDetachOpensResumeWindow(t *testing.T) {
+	logger := logging.Logger.WithField("test", t.Name())
+	rs := &roomSockets{}
+	first, second := &w.ThreadSafeWriter{}, &w.ThreadSafeWriter{}
+	_, token, _ := rs.attachBroadcaster(first, "")
+
+	if !rs.detachBroadcaster(first, time.Minute, logger) {
+		t.Fatal("detach of the current socket reported as replaced")
+	}
+	resumed, _, replaced := rs.attachBroadcaster(second, token)
+	if !resumed || replaced != nil {
+		t.Errorf("resume inside the window = %v, %v", resumed, replaced)
+	}
+	// The socket second replaced must not clear its slot on the way out
+	if rs.detachBroadcaster(first, time.Minute, logger) {
+		t.Error("a replaced socket detached the current one")
+	}
+	if rs.broadcaster != second {
+		t.Error("the slot was lost")
+	}
+}
+
+func TestResumeWindowExpires(t *testing.T) {
+	logger := logging.Logger.WithField("test", t.Name())
+	rs := &roomSockets{}
+	first := &w.ThreadSafeWriter{}
+	_, token, _ := rs.attachBroadcaster(first, "")
+	rs.lastOffer = &wsMessage{Event: "offer", Data: "sdp"}
+
+	rs.detachBroadcaster(first, 10*time.Millisecond, logger)
+	deadline := time.Now().Add(time.Second)
+	for {
+		rs.mu.RLock()
+		expired := rs.resumeToken == ""
+		rs.mu.RUnlock()
+		if expired {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("resume window never expired")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	resumed, fresh, _ := rs.attachBroadcaster(&w.ThreadSafeWriter{}, token)
+	if resumed || fresh == token {
+		t.Errorf("resumed after the window with %q", fresh)
+	}
+	if rs.lastOffer != nil {
+		t.Error("the expired session's offer is still cached")
+	}
+}
@@ -3,33 +3,42 @@ package handlers
 import (
 	"crypto/sha256"
 	"fmt"
-	"log"
 
 	"github.com/gofiber/websocket/v2"
-	"github.com/pion/webrtc/v3"
+	"webrtc-streaming/pkg/logging"
+	"webrtc-streaming/pkg/signaling"
 	w "webrtc-streaming/pkg/webrtc"
 )
 
 // Broadcaster WebSocket: the victim connects here
 func RoomWebsocket(c *websocket.Conn) {
 	uuid := c.Params("uuid")
+	logger := wsLogger(c, uuid)
 	if uuid == "" {
-		log.Println("RoomWebsocket: missing uuid")
+		logger.Warn("RoomWebsocket: missing uuid")
+		return
+	}
+	// SFU rooms share the IDs help requests hand out
+	if !knownRoom(uuid) {
+		logger.Warn("RoomWebsocket: room not found")
+		ws := w.NewWriter(c)
+		ws.Fail(signaling.NewError(signaling.CodeRoomNotFound, "", "room %s not found", uuid), signaling.CloseRoomNotFound)
 		return
 	}
 
 	_, _, room := createOrGetRoom(uuid)
-	log.Printf("Broadcaster connected to room: %s\n", uuid)
+	logger.Info("Broadcaster connected to room")
 
 	// Hand over to signaling-aware broadcaster handler
-	w.RoomConn(c, room.Peers, room)
+	w.RoomConn(logging.WithContext(sessionContext(uuid), logger), c, room.Peers, room)
 }
 
 // Viewer WebSocket: the helper connects here
 func RoomViewerWebsocket(c *websocket.Conn) {
 	uuid := c.Params("uuid")
+	logger := wsLogger(c, uuid)
 	if uuid == "" {
-		log.Println("RoomViewerWebsocket: missing uuid")
+		logger.Warn("RoomViewerWebsocket: missing uuid")
 		return
 	}
 
@@ -38,15 +47,17 @@ func RoomViewerWebsocket(c *websocket.Conn) {
 	room, ok := w.Rooms[uuid]
 	w.RoomsLock.RUnlock()
 
-	if !ok || room == nil {
-		log.Printf("RoomViewerWebsocket: room not found for uuid %s\n", uuid)
+	if !ok || room == nil || !knownRoom(uuid) {
+		logger.Warn("RoomViewerWebsocket: room not found")
+		ws := w.NewWriter(c)
+		ws.Fail(signaling.NewError(signaling.CodeRoomNotFound, "", "room %s not found", uuid), signaling.CloseRoomNotFound)
 		return
 	}
 
-	log.Printf("Viewer connected to room: %s\n", uuid)
+	logger.Info("Viewer connected to room")
 
 	// Hand over to signaling-aware viewer handler
-	w.StreamConn(c, room.Peers, room)
+	w.StreamConn(logging.WithContext(sessionContext(uuid), logger), c, room.Peers, room)
 }
 
 // Create or retrieve room safely; also make sure global registries are initialized
@@ -74,9 +85,10 @@ func createOrGetRoom(uuid string) (string, string, *w.Room) {
 
 	// Create new room
 	peers := &w.Peers{
-		TrackLocals: make(map[string]*webrtc.TrackLocalStaticRTP),
+		TrackLocals: make(map[string]*w.ForwardTrack),
 	}
 	room := &w.Room{
+		ID:    uuid,
 		Peers: peers,
 	}
 	// Important: let peers know their room
@@ -85,7 +97,7 @@ func createOrGetRoom(uuid string) (string, string, *w.Room) {
 	w.Rooms[uuid] = room
 	w.Streams[suuid] = room
 
-	log.Printf("New room created: %s (stream ID: %s)\n", uuid, suuid)
+	logging.Room(uuid).WithField("stream", suuid).Info("New room created")
 	return uuid, suuid, room
 }
 
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	w "webrtc-streaming/pkg/webrtc"
+)
+
+// GET /stats
+// Live connection quality of every room
+func Stats(c *fiber.Ctx) error {
+	w.RoomsLock.RLock()
+	rooms := make(map[string]*w.Room, len(w.Rooms))
+	for id, room := range w.Rooms {
+		rooms[id] = room
+	}
+	w.RoomsLock.RUnlock()
+
+	ids := make([]string, 0, len(rooms))
+	for id := range rooms {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	stats := make([]w.RoomStats, 0, len(ids))
+	for _, id := range ids {
+		if rooms[id] != nil {
+			stats = append(stats, rooms[id].Stats(id))
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"timestamp": time.Now().Unix(),
+		"rooms":     stats,
+	})
+}
+
+// GET /stats/:roomId
+// Live connection quality of one room, per peer
+func RoomStats(c *fiber.Ctx) error {
+	roomID := c.Params("roomId")
+
+	w.RoomsLock.RLock()
+	room, ok := w.Rooms[roomID]
+	w.RoomsLock.RUnlock()
+
+	if !ok || room == nil {
+		httpLogger(c, roomID).Warn("RoomStats: room not found")
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Room not found"})
+	}
+
+	return c.JSON(fiber.Map{
+		"timestamp": time.Now().Unix(),
+		"room":      room.Stats(roomID),
+	})
+}
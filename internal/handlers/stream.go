@@ -1,13 +1,12 @@
 package handlers
 
 import (
-	"fmt"
-	"log"
-	"os"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
+	"webrtc-streaming/pkg/logging"
+	"webrtc-streaming/pkg/signaling"
 	w "webrtc-streaming/pkg/webrtc"
 )
 
@@ -15,29 +14,25 @@ import (
 // Returns stream metadata + websocket endpoints
 func Stream(c *fiber.Ctx) error {
 	suuid := c.Params("suuid")
+	logger := httpLogger(c, "").WithField("stream", suuid)
 	if suuid == "" {
-		log.Println("Stream: missing stream ID")
+		logger.Warn("Stream: missing stream ID")
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing stream ID"})
 	}
 
-	protocol := "ws"
-	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
-		protocol = "wss"
-	}
-
 	w.RoomsLock.RLock()
 	stream, ok := w.Streams[suuid]
 	w.RoomsLock.RUnlock()
 
 	if !ok || stream == nil {
-		log.Printf("Stream: stream not found for ID %s\n", suuid)
+		logger.Warn("Stream: stream not found")
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"streamId": suuid,
 			"status":   "not_found",
 		})
 	}
 
-	log.Printf("Stream: metadata served for stream ID %s\n", suuid)
+	logger.WithField(logging.RoomID, stream.ID).Debug("Stream: metadata served")
 	return c.JSON(fiber.Map{
 		"streamId":        suuid,
 		"status":          "active",
@@ -45,9 +40,9 @@ func Stream(c *fiber.Ctx) error {
 		"hostname":        c.Hostname(),
 		"type":            "stream",
 		// Broadcaster (victim) WS endpoint for this stream
-		"streamWebSocket": fmt.Sprintf("%s://%s/stream/%s/websocket", protocol, c.Hostname(), suuid),
+		"streamWebSocket": wsURL(c, "/stream/"+suuid+"/websocket"),
 		// Viewer (helper) WS endpoint for this stream
-		"viewerWebSocket": fmt.Sprintf("%s://%s/stream/%s/viewer/websocket", protocol, c.Hostname(), suuid),
+		"viewerWebSocket": wsURL(c, "/stream/"+suuid+"/viewer/websocket"),
 	})
 }
 
@@ -55,8 +50,9 @@ func Stream(c *fiber.Ctx) error {
 // Broadcaster (victim) WebSocket: creates PC, receives remote tracks, relays SDP/ICE to viewers
 func StreamWebSocket(c *websocket.Conn) {
 	suuid := c.Params("suuid")
+	logger := wsLogger(c, "").WithField("stream", suuid)
 	if suuid == "" {
-		log.Println("StreamWebSocket: missing stream ID")
+		logger.Warn("StreamWebSocket: missing stream ID")
 		return
 	}
 
@@ -65,21 +61,25 @@ func StreamWebSocket(c *websocket.Conn) {
 	w.RoomsLock.RUnlock()
 
 	if !ok || stream == nil {
-		log.Printf("StreamWebSocket: stream not found for ID %s\n", suuid)
+		logger.Warn("StreamWebSocket: stream not found")
+		ws := w.NewWriter(c)
+		ws.Fail(signaling.NewError(signaling.CodeRoomNotFound, "", "stream %s not found", suuid), signaling.CloseRoomNotFound)
 		return
 	}
 
-	log.Printf("Broadcaster connected to stream: %s\n", suuid)
+	logger = logger.WithField(logging.RoomID, stream.ID)
+	logger.Info("Broadcaster connected to stream")
 	// IMPORTANT: broadcaster uses RoomConn (role=broadcaster inside)
-	w.RoomConn(c, stream.Peers, stream)
+	w.RoomConn(logging.WithContext(sessionContext(stream.ID), logger), c, stream.Peers, stream)
 }
 
 // WS /stream/:suuid/viewer/websocket
 // Viewer (helper) WebSocket: receives the offer from Peers, sends answer/ICE back
 func StreamViewerWebSocket(c *websocket.Conn) {
 	suuid := c.Params("suuid")
+	logger := wsLogger(c, "").WithField("stream", suuid)
 	if suuid == "" {
-		log.Println("StreamViewerWebSocket: missing stream ID")
+		logger.Warn("StreamViewerWebSocket: missing stream ID")
 		return
 	}
 
@@ -88,11 +88,14 @@ func StreamViewerWebSocket(c *websocket.Conn) {
 	w.RoomsLock.RUnlock()
 
 	if !ok || stream == nil {
-		log.Printf("StreamViewerWebSocket: stream not found for ID %s\n", suuid)
+		logger.Warn("StreamViewerWebSocket: stream not found")
+		ws := w.NewWriter(c)
+		ws.Fail(signaling.NewError(signaling.CodeRoomNotFound, "", "stream %s not found", suuid), signaling.CloseRoomNotFound)
 		return
 	}
 
-	log.Printf("Viewer connected to stream: %s\n", suuid)
+	logger = logger.WithField(logging.RoomID, stream.ID)
+	logger.Info("Viewer connected to stream")
 	// IMPORTANT: viewer uses StreamConn (role=viewer inside)
-	w.StreamConn(c, stream.Peers, stream)
+	w.StreamConn(logging.WithContext(sessionContext(stream.ID), logger), c, stream.Peers, stream)
 }
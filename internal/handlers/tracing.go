@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("webrtc-streaming/internal/handlers")
+
+// One span per help request, from StartHelpSession to HelpCompleted, keyed by room ID.
+// Everything else that happens for the room is traced as its children.
+// Requests that are never completed end after sessionSpanTTL.
+var (
+	sessionsMu     sync.Mutex
+	sessionSpans   = map[string]*sessionSpan{}
+	sessionSpanTTL = 2 * time.Hour
+)
+
+type sessionSpan struct {
+	span   trace.Span
+	expire *time.Timer
+}
+
+// Start the help request span for a room unless one is already open
+func startSessionSpan(roomID, zone string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if _, ok := sessionSpans[roomID]; ok {
+		return
+	}
+	_, span := tracer.Start(context.Background(), "help-request",
+		trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("zone", zone)))
+	s := &sessionSpan{span: span}
+	s.expire = time.AfterFunc(sessionSpanTTL, func() { expireSessionSpan(roomID, s) })
+	sessionSpans[roomID] = s
+}
+
+// End a help request span nobody completed, unless it was replaced meanwhile
+func expireSessionSpan(roomID string, s *sessionSpan) {
+	sessionsMu.Lock()
+	if sessionSpans[roomID] != s {
+		sessionsMu.Unlock()
+		return
+	}
+	delete(sessionSpans, roomID)
+	sessionsMu.Unlock()
+	s.span.SetAttributes(attribute.Bool("session.expired", true))
+	s.span.End()
+}
+
+// Context carrying the room's help request span, if any
+func sessionContext(roomID string) context.Context {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	ctx := context.Background()
+	if s, ok := sessionSpans[roomID]; ok {
+		ctx = trace.ContextWithSpan(ctx, s.span)
+	}
+	return ctx
+}
+
+func endSessionSpan(roomID string) {
+	sessionsMu.Lock()
+	s, ok := sessionSpans[roomID]
+	delete(sessionSpans, roomID)
+	sessionsMu.Unlock()
+	if ok {
+		s.expire.Stop()
+		s.span.End()
+	}
+}
+
+// Start a span for one step of a room's session
+func startRoomSpan(roomID, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("room.id", roomID))
+	return tracer.Start(sessionContext(roomID), name, trace.WithAttributes(attrs...))
+}
+
+// Record a relayed signaling message as a short span under the connection's span
+func traceRelay(ctx context.Context, event, to string, err error) {
+	_, span := tracer.Start(ctx, "relay "+relayEventLabel(event),
+		trace.WithAttributes(attribute.String("relay.to", to)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
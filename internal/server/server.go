@@ -1,21 +1,80 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"log"
-	"os"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
+	fiberlogger "github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/gofiber/websocket/v2"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
 
+	"webrtc-streaming/internal/config"
 	"webrtc-streaming/internal/handlers"
+	"webrtc-streaming/internal/tracing"
+	"webrtc-streaming/pkg/logging"
+	"webrtc-streaming/pkg/signaling"
+	"webrtc-streaming/pkg/turnserver"
+	w "webrtc-streaming/pkg/webrtc"
 )
 
-func Run() {
-	app := fiber.New()
+func Run(cfg *config.Config) {
+	if err := logging.Apply(cfg.Log.Format, cfg.Log.Level, cfg.Log.Redact); err != nil {
+		log.Fatalf("Invalid logging config: %v", err)
+	}
+	logger := logging.Logger
+
+	if err := w.SetCodecPolicy(cfg.Codecs); err != nil {
+		logger.Fatalf("Invalid codec policy: %v", err)
+	}
+	logger.WithField("codecs", cfg.Codecs.Video).Info("Video codecs in preference order")
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Exporter)
+	if err != nil {
+		logger.Fatalf("Tracing setup failed: %v", err)
+	}
+
+	// The embedded TURN server verifies the credentials minted below
+	var turnServer *turnserver.Server
+	if cfg.TURN.Embedded.Enabled {
+		if turnServer, err = turnserver.Start(cfg.TURN.Embedded.Config); err != nil {
+			logger.Fatalf("Failed to start embedded TURN server: %v", err)
+		}
+		logger.WithField("urls", cfg.TURN.URLs).Info("Advertising embedded TURN server")
+	}
+
+	if len(cfg.ICE.Servers) == 0 && cfg.TURN.Secret == "" && cfg.Production() {
+		logger.Warn("No ICE servers configured; peers behind NAT may not connect")
+	}
+	if cfg.TURN.Secret != "" {
+		// Each server-side PeerConnection gets its own short-lived TURN credentials
+		w.SetRTCConfigurationFunc(func() webrtc.Configuration {
+			return cfg.ICEFor(fmt.Sprintf("sfu-%d", time.Now().UnixNano()), time.Now()).RTCConfiguration()
+		})
+	} else {
+		w.SetRTCConfiguration(cfg.ICE.RTCConfiguration())
+	}
+	w.SetMaxICERestarts(cfg.ICE.RestartAttempts)
+	w.SetHeartbeat(w.HeartbeatConfig{
+		PingInterval: cfg.WebSocket.PingInterval,
+		ReadTimeout:  cfg.WebSocket.ReadTimeout,
+		WriteTimeout: cfg.WebSocket.WriteTimeout,
+	})
+	handlers.Configure(cfg)
 
-	app.Use(logger.New())
+	app := fiber.New(fiber.Config{
+		ReadTimeout:  cfg.Timeouts.Read,
+		WriteTimeout: cfg.Timeouts.Write,
+		IdleTimeout:  cfg.Timeouts.Idle,
+	})
+
+	app.Use(requestid.New())
+	app.Use(fiberlogger.New())
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "*",
 		AllowHeaders: "*",
@@ -34,24 +93,52 @@ func Run() {
 	api.Post("/help_completed", handlers.HelpCompleted)
 	api.Get("/session_info", handlers.SessionInfo)
 
+	// ICE servers for clients, the same list the server uses
+	app.Get("/ice-servers", handlers.ICEServers)
+
+	// Connection quality and metrics
+	app.Get("/stats", handlers.RequireOperator, handlers.Stats)
+	app.Get("/stats/:roomId", handlers.RequireOperator, handlers.RoomStats)
+	app.Get("/metrics", handlers.RequireOperator, handlers.Metrics)
+
 	// WS upgrade guard
-	app.Use("/duress/:roomId/*", func(c *fiber.Ctx) error {
+	requireUpgrade := func(c *fiber.Ctx) error {
 		if websocket.IsWebSocketUpgrade(c) {
 			return c.Next()
 		}
 		return fiber.ErrUpgradeRequired
-	})
+	}
+	app.Use("/duress/:roomId/*", requireUpgrade)
+	app.Use("/room/:uuid/*", requireUpgrade)
 
 	// WS endpoints
-	app.Get("/duress/:roomId/websocket", websocket.New(handlers.DuressWebSocket))
-	app.Get("/duress/:roomId/viewer/websocket", websocket.New(handlers.DuressViewerWebSocket))
+	// Clients ask for a signaling version with the duress.vN subprotocol
+	wsConfig := websocket.Config{Subprotocols: signaling.Subprotocols}
+	app.Get("/duress/:roomId/websocket", websocket.New(handlers.DuressWebSocket, wsConfig))
+	app.Get("/duress/:roomId/viewer/websocket", websocket.New(handlers.DuressViewerWebSocket, wsConfig))
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// SFU: the server terminates both PeerConnections and forwards media
+	app.Get("/room/:uuid/websocket", websocket.New(handlers.RoomWebsocket, wsConfig))
+	app.Get("/room/:uuid/viewer/websocket", websocket.New(handlers.RoomViewerWebsocket, wsConfig))
+	app.Get("/stream/:suuid", handlers.Stream)
+	app.Get("/stream/:suuid/websocket", requireUpgrade, websocket.New(handlers.StreamWebSocket, wsConfig))
+	app.Get("/stream/:suuid/viewer/websocket", requireUpgrade, websocket.New(handlers.StreamViewerWebSocket, wsConfig))
+
+	logger.WithFields(logrus.Fields{
+		"addr":        cfg.Server.ListenAddr,
+		"environment": cfg.Environment,
+		"tls":         cfg.TLSEnabled(),
+	}).Info("Listening")
+	if cfg.TLSEnabled() {
+		err = app.ListenTLS(cfg.Server.ListenAddr, cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile)
+	} else {
+		err = app.Listen(cfg.Server.ListenAddr)
 	}
-	log.Printf("Listening on :%s\n", port)
-	if err := app.Listen(":" + port); err != nil {
-		log.Fatal(err)
+	if err != nil {
+		_ = shutdownTracing(context.Background())
+		if turnServer != nil {
+			_ = turnServer.Close()
+		}
+		logger.Fatal(err)
 	}
 }
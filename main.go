@@ -1,7 +1,21 @@
 package main
 
-import "webrtc-streaming/internal/server"
+import (
+	"flag"
+	"log"
+	"os"
+
+	"webrtc-streaming/internal/config"
+	"webrtc-streaming/internal/server"
+)
 
 func main() {
-	server.Run()
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	server.Run(cfg)
 }
@@ -0,0 +1,119 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Correlation fields attached to log lines
+const (
+	RoomID    = "room"
+	RequestID = "request_id"
+	Role      = "role"
+	ConnID    = "conn"
+)
+
+// Logger is the process-wide structured logger
+var Logger = logrus.New()
+
+func init() {
+	Logger.SetFormatter(&redactingFormatter{inner: textFormatter()})
+}
+
+// Apply sets the format (json or logfmt, default logfmt), level (debug, info,
+// warn or error, default info) and whether secrets are redacted
+func Apply(format, levelName string, redact bool) error {
+	var formatter logrus.Formatter
+	switch format {
+	case "", "logfmt", "text":
+		formatter = textFormatter()
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown LOG_FORMAT %q (want json or logfmt)", format)
+	}
+
+	level := logrus.InfoLevel
+	if levelName != "" {
+		parsed, err := logrus.ParseLevel(levelName)
+		if err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL: %v", err)
+		}
+		level = parsed
+	}
+
+	if redact {
+		formatter = &redactingFormatter{inner: formatter}
+	}
+
+	Logger.SetFormatter(formatter)
+	Logger.SetLevel(level)
+	return nil
+}
+
+func textFormatter() logrus.Formatter {
+	return &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+}
+
+type ctxKey struct{}
+
+// WithContext stores entry in ctx so callees log with the same correlation fields
+func WithContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, ctxKey{}, entry)
+}
+
+// FromContext returns the entry stored in ctx, or a bare one
+func FromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(ctxKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(Logger)
+}
+
+// Room returns an entry tagged with a room ID
+func Room(roomID string) *logrus.Entry {
+	return Logger.WithField(RoomID, roomID)
+}
+
+var (
+	// Phone-like digit runs; longer runs such as room IDs are left alone
+	mobilePattern = regexp.MustCompile(`(^|[^\w-])\+?\d[\d ()-]{6,14}\d($|[^\w-])`)
+	// An SDP body from its version line onwards
+	sdpPattern = regexp.MustCompile(`(?s)v=0\r?\n.*`)
+	// Field names whose values are always hidden
+	sensitiveFields = map[string]bool{"mobile": true, "phone": true, "sdp": true}
+)
+
+// redactingFormatter hides mobile numbers and SDP in messages and fields
+type redactingFormatter struct {
+	inner logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	clean := *entry
+	clean.Message = redact(entry.Message)
+	clean.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		if sensitiveFields[k] {
+			clean.Data[k] = "[redacted]"
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			clean.Data[k] = redact(v)
+		case error:
+			clean.Data[k] = redact(v.Error())
+		default:
+			clean.Data[k] = v
+		}
+	}
+	return f.inner.Format(&clean)
+}
+
+func redact(s string) string {
+	s = sdpPattern.ReplaceAllString(s, "[sdp redacted]")
+	return mobilePattern.ReplaceAllString(s, "${1}[mobile redacted]${2}")
+}
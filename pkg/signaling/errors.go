@@ -0,0 +1,52 @@
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Error codes carried in "error" events
+const (
+	CodeInvalidMessage     = "invalid-message"     // not a well-formed frame
+	CodeUnsupportedVersion = "unsupported-version" // frame of another protocol version
+	CodeUnknownEvent       = "unknown-event"
+	CodeInvalidSDP         = "invalid-sdp"   // offer or answer rejected
+	CodeBadCandidate       = "bad-candidate" // candidate rejected
+	CodeRoomNotFound       = "room-not-found"
+	CodeUnsupportedCodec   = "unsupported-codec" // no video codec shared with the broadcaster
+	CodeCapacity           = "capacity"          // a server-side limit was reached
+	CodeICEFailed          = "ice-failed"        // ICE restarts exhausted
+	CodeInternal           = "internal"
+)
+
+// WebSocket close codes. The 4xxx application codes mirror HTTP statuses.
+const (
+	CloseNormal       = 1000 // bye, duress-stop
+	CloseGoingAway    = 1001 // heartbeat missed
+	CloseUnsupported  = 1003 // with CodeUnsupportedCodec
+	CloseInternal     = 1011
+	CloseRoomNotFound = 4404
+	CloseReplaced     = 4409 // another socket took this role
+)
+
+// Error is sent back for a frame or connection the server could not accept
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Ref     string `json:"ref,omitempty"` // event or type the error is about
+}
+
+// NewError builds an error about ref (may be empty)
+func NewError(code, ref, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...), Ref: ref}
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Event is the error as an "error" message
+func (e *Error) Event() Message {
+	data, _ := json.Marshal(e)
+	return Message{Event: "error", Data: string(data)}
+}
@@ -0,0 +1,33 @@
+package signaling
+
+import "encoding/json"
+
+// Participant is someone in a room as presence events describe them
+type Participant struct {
+	Role string `json:"role"`           // broadcaster or viewer
+	Name string `json:"name,omitempty"` // display name, if known
+	ID   string `json:"id,omitempty"`   // connection ID where a role can have several
+}
+
+// Joined tells the rest of the room that p connected
+func Joined(p Participant) Message {
+	return presence("participant-joined", p)
+}
+
+// Left tells the rest of the room that p disconnected
+func Left(p Participant) Message {
+	return presence("participant-left", p)
+}
+
+// Roster is sent to a new participant with everyone else already in the room
+func Roster(others []Participant) Message {
+	if others == nil {
+		others = []Participant{}
+	}
+	return presence("roster", others)
+}
+
+func presence(event string, v interface{}) Message {
+	data, _ := json.Marshal(v)
+	return Message{Event: event, Data: string(data)}
+}
@@ -0,0 +1,295 @@
+// Package signaling is the wire format of the signaling WebSockets.
+//
+// Version 0 is the original Android format, {"event": ..., "data": "<string>"},
+// where data holds raw SDP, a JSON-encoded candidate or plain text depending on
+// the event. Version 1 wraps typed payloads in {"v": 1, "type": ..., "payload":
+// {...}}. Clients pick v1 with the WebSocket subprotocol "duress.v1" (or ?v=1);
+// everyone else speaks v0. Internally every frame is a v0-style Message, and
+// each connection's Codec translates at the socket.
+package signaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	V0     = 0
+	V1     = 1
+	Latest = V1
+)
+
+// Subprotocols are offered during the WebSocket handshake, newest first
+var Subprotocols = []string{"duress.v1"}
+
+// Message is one signaling event as the handlers see it, and the v0 frame
+type Message struct {
+	Event  string `json:"event"`
+	Data   string `json:"data"`
+	RoomID string `json:"roomId,omitempty"`
+}
+
+// Envelope is a v1 frame
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// v1 payloads
+type (
+	SDP struct {
+		SDP string `json:"sdp"`
+	}
+	Bye struct {
+		Reason string `json:"reason,omitempty"`
+	}
+	// Control carries everything that is not SDP or ICE: heartbeats, layer
+	// selection, audio-only, presence and so on. Action is the v0 event name.
+	Control struct {
+		Action string `json:"action"`
+		Data   string `json:"data,omitempty"`
+	}
+)
+
+// Events clients may send besides offer, answer and candidate
+var clientEvents = map[string]bool{
+	"end-of-candidates": true,
+	"bye":               true,
+	"error":             true,
+	"heartbeat":         true,
+	"ice-restart":       true,
+	"select-layer":      true,
+	"audio-only":        true,
+	"duress-alert":      true,
+	"duress-stop":       true,
+}
+
+// Codec reads and writes one connection's protocol version
+type Codec struct {
+	Version int
+}
+
+// Negotiate picks the version for c: the accepted subprotocol, else ?v=,
+// else v0. Versions newer than Latest get Latest.
+func Negotiate(c *websocket.Conn) Codec {
+	version := V0
+	if p := c.Subprotocol(); strings.HasPrefix(p, "duress.v") {
+		version, _ = strconv.Atoi(strings.TrimPrefix(p, "duress.v"))
+	} else if v, err := strconv.Atoi(c.Query("v")); err == nil {
+		version = v
+	}
+	if version < V0 {
+		version = V0
+	}
+	if version > Latest {
+		version = Latest
+	}
+	return Codec{Version: version}
+}
+
+// Hello tells a v1+ client which version the server settled on; v0 clients
+// get nothing new
+func (c Codec) Hello() (Message, bool) {
+	if c.Version == V0 {
+		return Message{}, false
+	}
+	return Message{Event: "hello", Data: strconv.Itoa(c.Version)}, true
+}
+
+// Decode parses and validates a frame from the client
+func (c Codec) Decode(raw []byte) (Message, *Error) {
+	if c.Version == V0 {
+		return decodeV0(raw)
+	}
+	return decodeV1(raw)
+}
+
+func decodeV0(raw []byte) (Message, *Error) {
+	var m Message
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return Message{}, NewError(CodeInvalidMessage, "", "not a JSON {event, data} frame: %v", err)
+	}
+	if m.Event == "" {
+		return Message{}, NewError(CodeInvalidMessage, "", "missing event")
+	}
+	switch m.Event {
+	case "offer", "answer":
+		if _, err := sdpOf(m.Data); err != nil {
+			return Message{}, NewError(CodeInvalidSDP, m.Event, "%v", err)
+		}
+	case "candidate":
+		// Browsers mark the end of gathering with an empty candidate
+		if cand, err := candidateOf(m.Data); err != nil && cand.Candidate != "" {
+			return Message{}, NewError(CodeBadCandidate, m.Event, "%v", err)
+		}
+	}
+	// Other events pass through: v0 relays whatever the apps agree on
+	return m, nil
+}
+
+func decodeV1(raw []byte) (Message, *Error) {
+	var env Envelope
+	if err := strictUnmarshal(raw, &env); err != nil {
+		return Message{}, NewError(CodeInvalidMessage, "", "not a v1 frame: %v", err)
+	}
+	if env.V != V1 {
+		return Message{}, NewError(CodeUnsupportedVersion, env.Type, "version %d is not the negotiated version %d", env.V, V1)
+	}
+
+	switch env.Type {
+	case "offer", "answer":
+		var p SDP
+		if err := strictUnmarshal(env.Payload, &p); err != nil {
+			return Message{}, NewError(CodeInvalidMessage, env.Type, "payload: %v", err)
+		}
+		if _, err := sdpOf(p.SDP); err != nil {
+			return Message{}, NewError(CodeInvalidSDP, env.Type, "%v", err)
+		}
+		return Message{Event: env.Type, Data: p.SDP}, nil
+
+	case "candidate":
+		var p webrtc.ICECandidateInit
+		if err := strictUnmarshal(env.Payload, &p); err != nil {
+			return Message{}, NewError(CodeInvalidMessage, env.Type, "payload: %v", err)
+		}
+		// Browsers mark the end of gathering with an empty candidate
+		if p.Candidate == "" {
+			return Message{Event: "end-of-candidates"}, nil
+		}
+		if err := validCandidate(p); err != nil {
+			return Message{}, NewError(CodeBadCandidate, env.Type, "%v", err)
+		}
+		data, _ := json.Marshal(p)
+		return Message{Event: "candidate", Data: string(data)}, nil
+
+	case "end-of-candidates":
+		return Message{Event: env.Type}, nil
+
+	case "bye":
+		var p Bye
+		if len(env.Payload) > 0 {
+			if err := strictUnmarshal(env.Payload, &p); err != nil {
+				return Message{}, NewError(CodeInvalidMessage, env.Type, "payload: %v", err)
+			}
+		}
+		return Message{Event: "bye", Data: p.Reason}, nil
+
+	case "error":
+		var p Error
+		if err := strictUnmarshal(env.Payload, &p); err != nil || p.Code == "" {
+			return Message{}, NewError(CodeInvalidMessage, env.Type, "payload needs a code")
+		}
+		return p.Event(), nil
+
+	case "control":
+		var p Control
+		if err := strictUnmarshal(env.Payload, &p); err != nil {
+			return Message{}, NewError(CodeInvalidMessage, env.Type, "payload: %v", err)
+		}
+		if !clientEvents[p.Action] || !isControl(p.Action) {
+			return Message{}, NewError(CodeUnknownEvent, env.Type, "control action %q is not supported", p.Action)
+		}
+		return Message{Event: p.Action, Data: p.Data}, nil
+	}
+	return Message{}, NewError(CodeInvalidMessage, env.Type, "unknown type %q", env.Type)
+}
+
+// Encode turns m into the frame for this connection, or reports false when
+// the event has no meaning in its version
+func (c Codec) Encode(m Message) (interface{}, bool) {
+	if c.Version == V0 {
+		// v0 clients only learn a peer is done when its socket closes
+		if m.Event == "end-of-candidates" || m.Event == "bye" || m.Event == "hello" {
+			return nil, false
+		}
+		return m, true
+	}
+
+	env := Envelope{V: c.Version, Type: m.Event}
+	var payload interface{}
+	switch m.Event {
+	case "offer", "answer":
+		sdp, _ := sdpOf(m.Data)
+		payload = SDP{SDP: sdp}
+	case "candidate":
+		cand, err := candidateOf(m.Data)
+		if err != nil {
+			cand = webrtc.ICECandidateInit{Candidate: m.Data}
+		}
+		payload = cand
+	case "end-of-candidates":
+	case "bye":
+		payload = Bye{Reason: m.Data}
+	case "error":
+		var e Error
+		if json.Unmarshal([]byte(m.Data), &e) != nil || e.Code == "" {
+			e = Error{Code: "error", Message: m.Data}
+		}
+		payload = e
+	default:
+		env.Type = "control"
+		payload = Control{Action: m.Event, Data: m.Data}
+	}
+	if payload != nil {
+		env.Payload, _ = json.Marshal(payload)
+	}
+	return env, true
+}
+
+// Events carried in v1 control frames rather than a type of their own
+func isControl(event string) bool {
+	switch event {
+	case "offer", "answer", "candidate", "end-of-candidates", "bye", "error":
+		return false
+	}
+	return true
+}
+
+// SDP from plain SDP or a JSON {type, sdp} description, as v0 clients send both
+func sdpOf(data string) (string, error) {
+	sdp := data
+	if strings.HasPrefix(strings.TrimSpace(data), "{") {
+		var desc webrtc.SessionDescription
+		if err := json.Unmarshal([]byte(data), &desc); err != nil {
+			return "", fmt.Errorf("session description: %v", err)
+		}
+		sdp = desc.SDP
+	}
+	if !strings.HasPrefix(sdp, "v=") {
+		return "", fmt.Errorf("SDP must start with v=")
+	}
+	return sdp, nil
+}
+
+// Candidate from a JSON ICECandidateInit or a plain candidate line
+func candidateOf(data string) (webrtc.ICECandidateInit, error) {
+	var cand webrtc.ICECandidateInit
+	if err := json.Unmarshal([]byte(data), &cand); err != nil {
+		cand = webrtc.ICECandidateInit{Candidate: data}
+	}
+	return cand, validCandidate(cand)
+}
+
+func validCandidate(c webrtc.ICECandidateInit) error {
+	line := strings.TrimPrefix(c.Candidate, "a=")
+	if !strings.HasPrefix(line, "candidate:") {
+		return fmt.Errorf("candidate must start with candidate:")
+	}
+	return nil
+}
+
+func strictUnmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return fmt.Errorf("missing payload")
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
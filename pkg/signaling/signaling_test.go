@@ -0,0 +1,142 @@
+package signaling
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const testSDP = "v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n"
+
+func testCandidate(t *testing.T) string {
+	mid, index := "0", uint16(0)
+	data, err := json.Marshal(webrtc.ICECandidateInit{
+		Candidate:     "candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host",
+		SDPMid:        &mid,
+		SDPMLineIndex: &index,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRoundTrip(t *testing.T) {
+	messages := []Message{
+		{Event: "offer", Data: testSDP},
+		{Event: "answer", Data: testSDP},
+		{Event: "candidate", Data: testCandidate(t)},
+		{Event: "end-of-candidates"},
+		{Event: "bye", Data: "done"},
+		{Event: "heartbeat", Data: "42"},
+		{Event: "select-layer", Data: "h"},
+		{Event: "audio-only", Data: "on"},
+		NewError(CodeBadCandidate, "candidate", "no").Event(),
+	}
+
+	for _, version := range []int{V0, V1} {
+		codec := Codec{Version: version}
+		for _, want := range messages {
+			frame, ok := codec.Encode(want)
+			if !ok {
+				// v0 has no frame for these; the socket closing says it all
+				if version == V0 && (want.Event == "end-of-candidates" || want.Event == "bye") {
+					continue
+				}
+				t.Errorf("v%d: %s: not encoded", version, want.Event)
+				continue
+			}
+			raw, err := json.Marshal(frame)
+			if err != nil {
+				t.Fatalf("v%d: %s: %v", version, want.Event, err)
+			}
+			got, verr := codec.Decode(raw)
+			if verr != nil {
+				t.Errorf("v%d: %s: decode %s: %v", version, want.Event, raw, verr)
+				continue
+			}
+			if got != want {
+				t.Errorf("v%d: %s: got %+v, want %+v", version, want.Event, got, want)
+			}
+		}
+	}
+}
+
+func TestDecodeEmptyCandidate(t *testing.T) {
+	tests := []struct {
+		version int
+		raw     string
+		want    Message
+	}{
+		{V0, `{"event":"candidate","data":""}`, Message{Event: "candidate"}},
+		{V0, `{"event":"candidate","data":"{\"candidate\":\"\"}"}`, Message{Event: "candidate", Data: `{"candidate":""}`}},
+		{V1, `{"v":1,"type":"candidate","payload":{"candidate":""}}`, Message{Event: "end-of-candidates"}},
+	}
+	for _, tt := range tests {
+		got, err := Codec{Version: tt.version}.Decode([]byte(tt.raw))
+		if err != nil {
+			t.Errorf("v%d %s: %v", tt.version, tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("v%d %s: got %+v, want %+v", tt.version, tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeV0KeepsUnknownEvents(t *testing.T) {
+	raw := `{"event":"battery","data":"12"}`
+	got, err := Codec{Version: V0}.Decode([]byte(raw))
+	if err != nil {
+		t.Fatalf("rejected %s: %v", raw, err)
+	}
+	if want := (Message{Event: "battery", Data: "12"}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		raw     string
+		code    string
+	}{
+		{"v0 not json", V0, `offer`, CodeInvalidMessage},
+		{"v0 no event", V0, `{"data":"x"}`, CodeInvalidMessage},
+		{"v0 bad sdp", V0, `{"event":"offer","data":"nope"}`, CodeInvalidSDP},
+		{"v0 bad sdp json", V0, `{"event":"answer","data":"{\"sdp\":1}"}`, CodeInvalidSDP},
+		{"v0 bad candidate", V0, `{"event":"candidate","data":"nope"}`, CodeBadCandidate},
+		{"v1 not json", V1, `{"v":1,`, CodeInvalidMessage},
+		{"v1 unknown field", V1, `{"v":1,"type":"bye","extra":true}`, CodeInvalidMessage},
+		{"v1 other version", V1, `{"v":2,"type":"bye"}`, CodeUnsupportedVersion},
+		{"v1 v0 frame", V1, `{"event":"offer","data":"v=0"}`, CodeInvalidMessage},
+		{"v1 unknown type", V1, `{"v":1,"type":"launch"}`, CodeInvalidMessage},
+		{"v1 offer without payload", V1, `{"v":1,"type":"offer"}`, CodeInvalidMessage},
+		{"v1 bad sdp", V1, `{"v":1,"type":"offer","payload":{"sdp":"nope"}}`, CodeInvalidSDP},
+		{"v1 bad candidate", V1, `{"v":1,"type":"candidate","payload":{"candidate":"nope"}}`, CodeBadCandidate},
+		{"v1 error without code", V1, `{"v":1,"type":"error","payload":{"message":"x"}}`, CodeInvalidMessage},
+		{"v1 unknown control", V1, `{"v":1,"type":"control","payload":{"action":"launch"}}`, CodeUnknownEvent},
+		{"v1 offer as control", V1, `{"v":1,"type":"control","payload":{"action":"offer"}}`, CodeUnknownEvent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Codec{Version: tt.version}.Decode([]byte(tt.raw))
+			if err == nil {
+				t.Fatalf("accepted %s", tt.raw)
+			}
+			if err.Code != tt.code {
+				t.Errorf("code %q, want %q (%v)", err.Code, tt.code, err)
+			}
+		})
+	}
+}
+
+func TestEncodeV0SkipsNewEvents(t *testing.T) {
+	for _, event := range []string{"hello", "bye", "end-of-candidates"} {
+		if _, ok := (Codec{Version: V0}).Encode(Message{Event: event}); ok {
+			t.Errorf("%s encoded for v0", event)
+		}
+	}
+}
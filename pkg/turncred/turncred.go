@@ -0,0 +1,78 @@
+// Package turncred mints and checks time-limited TURN credentials using the
+// shared-secret scheme of the TURN REST API draft: the username is
+// "<expiry unix time>:<user ID>" and the password is
+// base64(HMAC-SHA1(secret, username)). The signaling server and the TURN
+// server only need to share the secret.
+package turncred
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Credentials for one TURN user
+type Credentials struct {
+	Username string
+	Password string
+	Expires  time.Time
+}
+
+// Mint returns credentials for userID valid until now+ttl
+func Mint(secret, userID string, ttl time.Duration, now time.Time) Credentials {
+	expires := now.Add(ttl).Truncate(time.Second)
+	username := strconv.FormatInt(expires.Unix(), 10) + ":" + userID
+	return Credentials{
+		Username: username,
+		Password: Password(secret, username),
+		Expires:  expires,
+	}
+}
+
+// Password derives the password for a username
+func Password(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	_, _ = mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks that username is well formed and not expired at now, and
+// returns the password the client must have been given
+func Verify(secret, username string, now time.Time) (string, bool) {
+	expiry, _, ok := split(username)
+	if !ok || now.Unix() > expiry {
+		return "", false
+	}
+	return Password(secret, username), true
+}
+
+// Expired reports whether username is in "<expiry>:<user ID>" form with an
+// expiry before now
+func Expired(username string, now time.Time) bool {
+	expiry, _, ok := split(username)
+	return ok && now.Unix() > expiry
+}
+
+// UserID is the user part of a minted username, or the username itself when
+// it is not in "<expiry>:<user ID>" form
+func UserID(username string) string {
+	if _, userID, ok := split(username); ok {
+		return userID
+	}
+	return username
+}
+
+func split(username string) (expiry int64, userID string, ok bool) {
+	i := strings.IndexByte(username, ':')
+	if i <= 0 {
+		return 0, "", false
+	}
+	expiry, err := strconv.ParseInt(username[:i], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return expiry, username[i+1:], true
+}
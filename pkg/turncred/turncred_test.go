@@ -0,0 +1,83 @@
+package turncred
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMintVerify(t *testing.T) {
+	now := time.Unix(1700000000, 500)
+	cred := Mint("secret", "room-victim", time.Hour, now)
+
+	if cred.Username != "1700003600:room-victim" {
+		t.Errorf("username %q", cred.Username)
+	}
+	if !cred.Expires.Equal(time.Unix(1700003600, 0)) {
+		t.Errorf("expires %v", cred.Expires)
+	}
+
+	password, ok := Verify("secret", cred.Username, now)
+	if !ok || password != cred.Password {
+		t.Errorf("Verify = %q, %v; want %q, true", password, ok, cred.Password)
+	}
+	if password, _ := Verify("other", cred.Username, now); password == cred.Password {
+		t.Error("another secret gives the same password")
+	}
+	if _, ok := Verify("secret", cred.Username, cred.Expires); !ok {
+		t.Error("rejected at the expiry second")
+	}
+	if _, ok := Verify("secret", cred.Username, cred.Expires.Add(time.Second)); ok {
+		t.Error("accepted after expiry")
+	}
+}
+
+func TestPassword(t *testing.T) {
+	// printf '1700003600:user' | openssl dgst -sha1 -hmac secret -binary | base64
+	if got := Password("secret", "1700003600:user"); got != "+H9F73rZRi2gwSWIwTpuw+t6m9Q=" {
+		t.Errorf("Password = %q", got)
+	}
+}
+
+func TestVerifyRejectsMalformed(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, username := range []string{"", "user", ":user", "soon:user", "-:user"} {
+		if _, ok := Verify("secret", username, now); ok {
+			t.Errorf("accepted %q", username)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		username string
+		want     bool
+	}{
+		{"1699999999:room-victim", true},
+		{"1700000000:room-victim", false},
+		{"1700003600:room-victim", false},
+		{"alice", false},
+		{"alice:bob", false},
+		{":bob", false},
+	}
+	for _, tt := range tests {
+		if got := Expired(tt.username, now); got != tt.want {
+			t.Errorf("Expired(%q) = %v, want %v", tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestUserID(t *testing.T) {
+	tests := []struct{ username, want string }{
+		{"1700003600:room-victim", "room-victim"},
+		{"1700003600:a:b", "a:b"},
+		{"alice", "alice"},
+		{"alice:bob", "alice:bob"},
+		{":bob", ":bob"},
+	}
+	for _, tt := range tests {
+		if got := UserID(tt.username); got != tt.want {
+			t.Errorf("UserID(%q) = %q, want %q", tt.username, got, tt.want)
+		}
+	}
+}
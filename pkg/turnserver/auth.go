@@ -0,0 +1,86 @@
+package turnserver
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+	"webrtc-streaming/pkg/turncred"
+)
+
+// authenticator answers the server's AuthHandler from minted credentials
+// and static users, both replaceable on reload
+type authenticator struct {
+	realm  string
+	events *events
+
+	mu     sync.RWMutex
+	secret string            // empty when minted credentials are off
+	keys   map[string][]byte // static users
+}
+
+func newAuthenticator(realm string, events *events) *authenticator {
+	return &authenticator{realm: realm, events: events}
+}
+
+func (a *authenticator) update(c Auth) {
+	secret, keys := c.Secret, make(map[string][]byte)
+	if c.Mode == "static" {
+		secret = ""
+	}
+	if c.Mode != "secret" {
+		for username, password := range c.Users {
+			keys[username] = turn.GenerateAuthKey(username, a.realm, password)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.secret, a.keys = secret, keys
+}
+
+func (a *authenticator) handle(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	key, ok := a.key(username, realm)
+	if !ok {
+		reason := "unknown_user"
+		if turncred.Expired(username, time.Now()) {
+			reason = "expired"
+		}
+		a.events.authFailed(username, reason, srcAddr)
+	}
+	return key, ok
+}
+
+// The long-term credential key for username, if it is a valid user
+func (a *authenticator) key(username, realm string) ([]byte, bool) {
+	a.mu.RLock()
+	secret := a.secret
+	key, ok := a.keys[username]
+	a.mu.RUnlock()
+
+	// Minted "expiry:userId" credentials take precedence over static users
+	if secret != "" {
+		if password, valid := turncred.Verify(secret, username, time.Now()); valid {
+			return turn.GenerateAuthKey(username, realm, password), true
+		}
+	}
+	return key, ok
+}
+
+// Whether m carries a MESSAGE-INTEGRITY made with its user's key
+func (a *authenticator) verified(m *stun.Message) bool {
+	var (
+		username stun.Username
+		realm    stun.Realm
+	)
+	if username.GetFrom(m) != nil || realm.GetFrom(m) != nil {
+		return false
+	}
+	key, ok := a.key(username.String(), realm.String())
+	if !ok {
+		return false
+	}
+	return stun.MessageIntegrity(key).Check(m) == nil
+}
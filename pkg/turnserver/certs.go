@@ -0,0 +1,79 @@
+package turnserver
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"webrtc-streaming/pkg/logging"
+)
+
+// Certificate files are checked for changes at most this often
+const certCheckInterval = 30 * time.Second
+
+// certReloader serves the TLS certificate from disk, picking up renewed
+// files without a restart. A broken renewal keeps the previous certificate.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = r.latestModTime()
+	return nil
+}
+
+// Newest modification time of the certificate and key
+func (r *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(f); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now := time.Now(); now.Sub(r.checked) >= certCheckInterval {
+		r.checked = now
+		if r.latestModTime().After(r.modTime) {
+			if err := r.load(); err != nil {
+				logging.Logger.WithError(err).Error("TLS certificate reload failed, keeping the old one")
+			} else {
+				logging.Logger.WithField("cert", r.certFile).Info("TLS certificate reloaded")
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// TURN over TLS (turns:) listener using the reloading certificate
+func listenTLS(network, addr string, certs *certReloader) (net.Listener, error) {
+	return tls.Listen(network, addr, &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	})
+}
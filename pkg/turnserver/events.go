@@ -0,0 +1,215 @@
+package turnserver
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/sirupsen/logrus"
+	"webrtc-streaming/pkg/logging"
+	"webrtc-streaming/pkg/turncred"
+)
+
+// Requests still waiting for a response after this long are forgotten
+const requestTimeout = 30 * time.Second
+
+// Lifetimes of a granted permission and channel binding (RFC 5766 8 and 11)
+const (
+	permissionLifetime = 5 * time.Minute
+	channelLifetime    = 10 * time.Minute
+)
+
+// events pairs authenticated requests with the server's responses, to log
+// allocation create, refresh and delete and count what was granted
+type events struct {
+	mu       sync.Mutex
+	requests map[[stun.TransactionIDSize]byte]pendingRequest
+	rejected map[string]bool // clients the auth handler just turned away
+
+	// Expiry of each grant by client; a grant lapses unless renewed
+	permissions map[string]map[string]time.Time // peer IP
+	channels    map[string]map[uint16]time.Time // channel number
+}
+
+type pendingRequest struct {
+	user     string
+	lifetime time.Duration // requested by Refresh; zero deletes
+	peers    []string      // CreatePermission and ChannelBind
+	channel  uint16        // ChannelBind
+	at       time.Time
+}
+
+func newEvents() *events {
+	return &events{
+		requests:    make(map[[stun.TransactionIDSize]byte]pendingRequest),
+		rejected:    make(map[string]bool),
+		permissions: make(map[string]map[string]time.Time),
+		channels:    make(map[string]map[uint16]time.Time),
+	}
+}
+
+// The auth handler refused username; the error response that follows is not
+// counted again
+func (e *events) authFailed(username, reason string, client net.Addr) {
+	authFailures.WithLabelValues(reason).Inc()
+	allocationLog("auth_failed", turncred.UserID(username), client).
+		WithField("reason", reason).Warn("TURN user rejected")
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rejected[client.String()] = true
+}
+
+// Remember a request that carries credentials
+func (e *events) request(m *stun.Message) {
+	var username stun.Username
+	if err := username.GetFrom(m); err != nil {
+		return
+	}
+	req := pendingRequest{user: turncred.UserID(username.String()), lifetime: -1, at: time.Now()}
+	if v, err := m.Get(stun.AttrLifetime); err == nil && len(v) == 4 {
+		req.lifetime = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	for _, peer := range peerAddresses(m) {
+		req.peers = append(req.peers, peer.IP.String())
+	}
+	if v, err := m.Get(stun.AttrChannelNumber); err == nil && len(v) == 4 {
+		req.channel = binary.BigEndian.Uint16(v)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, r := range e.requests {
+		if req.at.Sub(r.at) > requestTimeout {
+			delete(e.requests, id)
+		}
+	}
+	e.requests[m.TransactionID] = req
+}
+
+// Match a response to its request
+func (e *events) response(m *stun.Message, to net.Addr) {
+	e.mu.Lock()
+	req, ok := e.requests[m.TransactionID]
+	delete(e.requests, m.TransactionID)
+	counted := e.rejected[to.String()]
+	delete(e.rejected, to.String())
+	e.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if m.Type.Class == stun.ClassErrorResponse {
+		var code stun.ErrorCodeAttribute
+		// A signed request refused as unauthorized or malformed had a bad password
+		if err := code.GetFrom(m); err == nil && !counted && (code.Code == stun.CodeUnauthorized || code.Code == stun.CodeBadRequest) {
+			authFailures.WithLabelValues("bad_credentials").Inc()
+			allocationLog("auth_failed", req.user, to).WithField("code", int(code.Code)).Warn("TURN request rejected")
+		}
+		return
+	}
+
+	switch m.Type.Method {
+	case stun.MethodAllocate:
+		var relayed stun.XORMappedAddress
+		entry := allocationLog("allocation_created", req.user, to)
+		if err := relayed.GetFromAs(m, stun.AttrXORRelayedAddress); err == nil {
+			entry = entry.WithField("relay", relayed.String())
+		}
+		entry.WithField("lifetime", responseLifetime(m).String()).Info("TURN allocation created")
+	case stun.MethodRefresh:
+		if req.lifetime == 0 {
+			e.revoke(to)
+			allocationLog("allocation_released", req.user, to).Info("TURN allocation released by client")
+			return
+		}
+		allocationLog("allocation_refreshed", req.user, to).
+			WithField("lifetime", responseLifetime(m).String()).Debug("TURN allocation refreshed")
+	case stun.MethodCreatePermission:
+		permissionsCreated.Inc()
+		e.grant(to, req.peers, 0)
+	case stun.MethodChannelBind:
+		channelBinds.Inc()
+		// A binding also installs or refreshes a permission for its peer
+		e.grant(to, req.peers, req.channel)
+	}
+}
+
+// Record permissions for peers, and a channel binding unless channel is 0
+func (e *events) grant(client net.Addr, peers []string, channel uint16) {
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := client.String()
+	if len(peers) > 0 && e.permissions[key] == nil {
+		e.permissions[key] = make(map[string]time.Time)
+	}
+	for _, peer := range peers {
+		e.permissions[key][peer] = now.Add(permissionLifetime)
+	}
+	if channel != 0 {
+		if e.channels[key] == nil {
+			e.channels[key] = make(map[uint16]time.Time)
+		}
+		e.channels[key][channel] = now.Add(channelLifetime)
+	}
+}
+
+// Drop every grant of a client whose allocation was deleted
+func (e *events) revoke(client net.Addr) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.permissions, client.String())
+	delete(e.channels, client.String())
+}
+
+// Permissions and channel bindings not yet expired; expired ones are dropped
+func (e *events) active() (permissions, channels int) {
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for client, peers := range e.permissions {
+		for peer, expires := range peers {
+			if now.After(expires) {
+				delete(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			delete(e.permissions, client)
+		}
+		permissions += len(peers)
+	}
+	for client, bound := range e.channels {
+		for channel, expires := range bound {
+			if now.After(expires) {
+				delete(bound, channel)
+			}
+		}
+		if len(bound) == 0 {
+			delete(e.channels, client)
+		}
+		channels += len(bound)
+	}
+	return permissions, channels
+}
+
+func responseLifetime(m *stun.Message) time.Duration {
+	v, err := m.Get(stun.AttrLifetime)
+	if err != nil || len(v) != 4 {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+}
+
+// Entry for an allocation event; client is the client's transport address
+func allocationLog(event, user string, client net.Addr) *logrus.Entry {
+	fields := logrus.Fields{"event": event, "user": user}
+	if client != nil {
+		fields["client"] = client.String()
+	}
+	return logging.Logger.WithFields(fields)
+}
@@ -0,0 +1,169 @@
+package turnserver
+
+import (
+	"net"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+)
+
+// guard sits between clients and the TURN server. It sees every STUN request
+// before the server handles it, and may answer it with an error instead, and
+// every message the server sends back.
+type guard struct {
+	auth   *authenticator
+	quotas *quotas
+	peers  *peerPolicy
+	events *events
+}
+
+// Inspect a datagram from a client; a non-nil reply rejects the request
+func (g *guard) request(raw []byte, from net.Addr) *stun.Message {
+	m, ok := decodeSTUN(raw)
+	if !ok || m.Type.Class != stun.ClassRequest {
+		return nil
+	}
+	switch m.Type.Method {
+	case stun.MethodAllocate:
+		// Unauthenticated requests are left to the server's challenge, so a
+		// spoofed USERNAME cannot take another user's slots
+		if !g.auth.verified(m) {
+			break
+		}
+		if code, ok := g.quotas.reserve(m, from); !ok {
+			return errorResponse(m, code)
+		}
+	case stun.MethodCreatePermission, stun.MethodChannelBind:
+		for _, peer := range peerAddresses(m) {
+			if !g.peers.check(m.Type.Method.String(), peer.IP, from) {
+				return errorResponse(m, stun.CodeForbidden)
+			}
+		}
+	}
+	g.events.request(m)
+	return nil
+}
+
+// Inspect a datagram the server sends to a client
+func (g *guard) response(raw []byte, to net.Addr) {
+	m, ok := decodeSTUN(raw)
+	if !ok || m.Type.Class == stun.ClassRequest || m.Type.Class == stun.ClassIndication {
+		return
+	}
+	if m.Type.Method == stun.MethodAllocate {
+		switch m.Type.Class {
+		case stun.ClassSuccessResponse:
+			g.quotas.allocated(m, to)
+		case stun.ClassErrorResponse:
+			g.quotas.release(m)
+		}
+	}
+	g.events.response(m, to)
+}
+
+func decodeSTUN(raw []byte) (*stun.Message, bool) {
+	if !stun.IsMessage(raw) {
+		return nil, false // ChannelData
+	}
+	m := &stun.Message{Raw: append([]byte(nil), raw...)}
+	if err := m.Decode(); err != nil {
+		return nil, false
+	}
+	return m, true
+}
+
+// Every XOR-PEER-ADDRESS; CreatePermission may carry several
+func peerAddresses(m *stun.Message) []stun.XORMappedAddress {
+	var peers []stun.XORMappedAddress
+	for _, a := range m.Attributes {
+		if a.Type != stun.AttrXORPeerAddress {
+			continue
+		}
+		one := &stun.Message{TransactionID: m.TransactionID}
+		one.Add(a.Type, a.Value)
+		var peer stun.XORMappedAddress
+		if err := peer.GetFromAs(one, stun.AttrXORPeerAddress); err == nil {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func errorResponse(req *stun.Message, code stun.ErrorCode) *stun.Message {
+	m, err := stun.Build(
+		stun.NewTransactionIDSetter(req.TransactionID),
+		stun.NewType(req.Type.Method, stun.ClassErrorResponse),
+		code,
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// UDP listener seen through the guard
+type guardedPacketConn struct {
+	net.PacketConn
+	guard *guard
+}
+
+func (c *guardedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		if reply := c.guard.request(p[:n], addr); reply != nil {
+			_, _ = c.PacketConn.WriteTo(reply.Raw, addr)
+			continue
+		}
+		return n, addr, nil
+	}
+}
+
+func (c *guardedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.guard.response(p, addr)
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// TCP or TLS listener whose connections are seen through the guard
+type guardedListener struct {
+	net.Listener
+	guard *guard
+}
+
+func (l *guardedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &guardedConn{Conn: conn, frames: turn.NewSTUNConn(conn), guard: l.guard}, nil
+}
+
+// Stream connection that hands the server one whole STUN or ChannelData
+// frame per Read, so each request can be inspected on its own
+type guardedConn struct {
+	net.Conn
+	frames *turn.STUNConn
+	guard  *guard
+}
+
+func (c *guardedConn) Read(p []byte) (int, error) {
+	for {
+		n, _, err := c.frames.ReadFrom(p)
+		if err != nil {
+			return n, err
+		}
+		if reply := c.guard.request(p[:n], c.RemoteAddr()); reply != nil {
+			_, _ = c.Conn.Write(reply.Raw)
+			continue
+		}
+		return n, nil
+	}
+}
+
+func (c *guardedConn) Write(p []byte) (int, error) {
+	c.guard.response(p, c.RemoteAddr())
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,80 @@
+package turnserver
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"webrtc-streaming/pkg/logging"
+)
+
+// TURN metrics. They join the default Prometheus registry when the first
+// server starts, so importing the package registers nothing.
+var (
+	permissionsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "turn_permissions_created_total",
+		Help: "CreatePermission requests granted.",
+	})
+
+	channelBinds = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "turn_channel_binds_total",
+		Help: "ChannelBind requests granted.",
+	})
+
+	peerRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "turn_peer_rejections_total",
+		Help: "CreatePermission and ChannelBind requests refused by the peer address policy.",
+	}, []string{"method"})
+
+	quotaRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "turn_quota_rejections_total",
+		Help: "Allocate requests refused by a quota, by quota.",
+	}, []string{"quota"})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "turn_auth_failures_total",
+		Help: "Failed authentications: unknown_user, expired or bad_credentials.",
+	}, []string{"reason"})
+
+	relayedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "turn_relayed_bytes_total",
+		Help: "Bytes relayed by user; in is from peers, out is to peers.",
+	}, []string{"user", "direction"})
+)
+
+var registerCounters sync.Once
+
+// Register the counters once per process and gauges reading q and e, which
+// the caller unregisters when its server closes. Gauges another running
+// server already exports are left to it and none returned.
+func registerMetrics(q *quotas, e *events) []prometheus.Collector {
+	registerCounters.Do(func() {
+		prometheus.MustRegister(permissionsCreated, channelBinds, peerRejections,
+			quotaRejections, authFailures, relayedBytes)
+	})
+
+	// Gauges are read from the quotas and grants at scrape time
+	gauges := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "turn_allocations_active",
+			Help: "Allocations with an open relay socket.",
+		}, func() float64 { return float64(q.active()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "turn_permissions_active",
+			Help: "Permissions granted and not yet expired.",
+		}, func() float64 { n, _ := e.active(); return float64(n) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "turn_channel_bindings_active",
+			Help: "Channel bindings granted and not yet expired.",
+		}, func() float64 { _, n := e.active(); return float64(n) }),
+	}
+	for i, g := range gauges {
+		if err := prometheus.Register(g); err != nil {
+			for _, registered := range gauges[:i] {
+				prometheus.Unregister(registered)
+			}
+			logging.Logger.WithError(err).Warn("TURN gauges already exported by another server")
+			return nil
+		}
+	}
+	return gauges
+}
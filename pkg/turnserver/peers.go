@@ -0,0 +1,106 @@
+package turnserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"webrtc-streaming/pkg/logging"
+)
+
+// Peer ranges relayed to only when explicitly allowed: loopback, link-local,
+// RFC1918, carrier-grade NAT, unspecified and their IPv6 counterparts
+var DefaultDeniedPeers = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// peerPolicy decides which peer addresses a client may relay to. An address
+// in an allowed range is permitted even when a denied range also covers it.
+type peerPolicy struct {
+	mu    sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newPeerPolicy(allow, deny []string) (*peerPolicy, error) {
+	p := &peerPolicy{}
+	if err := p.update(allow, deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Replace both lists; on error the policy is unchanged
+func (p *peerPolicy) update(allow, deny []string) error {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return fmt.Errorf("allow: %v", err)
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return fmt.Errorf("deny: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.allow, p.deny = allowNets, denyNets
+	return nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (p *peerPolicy) permits(ip net.IP) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, n := range p.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range p.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check a peer a client asked to reach, logging and counting refusals
+func (p *peerPolicy) check(method string, peer net.IP, from net.Addr) bool {
+	if p.permits(peer) {
+		return true
+	}
+	peerRejections.WithLabelValues(method).Inc()
+	logging.Logger.WithFields(logrus.Fields{
+		"event":  "peer_rejected",
+		"method": method,
+		"peer":   peer.String(),
+		"client": from.String(),
+	}).Warn("Relay to peer address refused by policy")
+	return false
+}
@@ -0,0 +1,85 @@
+package turnserver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDefaultDeniedPeers(t *testing.T) {
+	p, err := newPeerPolicy(nil, DefaultDeniedPeers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"198.51.100.7", true},
+		{"2001:db8::1", true},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.32.0.1", true},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:10.0.0.1", false}, // IPv4-mapped
+	}
+	for _, tt := range tests {
+		if got := p.permits(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("permits(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAllowOverridesDeny(t *testing.T) {
+	p, err := newPeerPolicy([]string{"10.0.5.0/24"}, DefaultDeniedPeers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.permits(net.ParseIP("10.0.5.9")) {
+		t.Error("allowed range still denied")
+	}
+	if p.permits(net.ParseIP("10.0.6.9")) {
+		t.Error("rest of the denied range allowed")
+	}
+}
+
+func TestPeerPolicyUpdate(t *testing.T) {
+	p, err := newPeerPolicy(nil, []string{" 203.0.113.0/24 ", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("203.0.113.5")
+	if p.permits(ip) {
+		t.Fatal("denied range allowed")
+	}
+
+	if err := p.update(nil, []string{"nope"}); err == nil {
+		t.Error("bad CIDR accepted")
+	}
+	if p.permits(ip) {
+		t.Error("a failed update changed the policy")
+	}
+
+	if err := p.update(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !p.permits(ip) {
+		t.Error("emptied policy still denies")
+	}
+}
+
+func TestNewPeerPolicyRejectsBadCIDR(t *testing.T) {
+	if _, err := newPeerPolicy([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("bad allow CIDR accepted")
+	}
+	if _, err := newPeerPolicy(nil, []string{"10.0.0.1"}); err == nil {
+		t.Error("address without a prefix length accepted")
+	}
+}
@@ -0,0 +1,320 @@
+package turnserver
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"webrtc-streaming/pkg/logging"
+	"webrtc-streaming/pkg/turncred"
+)
+
+// An Allocate request that passed the quota check but has no answer yet
+// holds its slot this long
+const pendingAllocateTimeout = 30 * time.Second
+
+// Throttled users are logged at most this often
+const throttleLogInterval = 10 * time.Second
+
+type pendingAllocate struct {
+	user string
+	at   time.Time
+}
+
+// quotas tracks live allocations by their relay sockets. Users are keyed by
+// the user part of minted credentials, so fresh credentials share a quota.
+type quotas struct {
+	mu      sync.Mutex
+	limits  Limits
+	pending map[[stun.TransactionIDSize]byte]pendingAllocate
+	relays  map[string]*relayConn // by relayed address
+	users   map[string]*userUsage
+	total   *tokenBucket
+}
+
+type userUsage struct {
+	allocations int
+	bucket      *tokenBucket
+	throttled   time.Time // last throttle log line
+}
+
+func newQuotas(l Limits) *quotas {
+	return &quotas{
+		limits:  l,
+		pending: make(map[[stun.TransactionIDSize]byte]pendingAllocate),
+		relays:  make(map[string]*relayConn),
+		users:   make(map[string]*userUsage),
+		total:   newTokenBucket(l.TotalKbps * 1000),
+	}
+}
+
+// Apply new limits; allocations already over them are kept
+func (q *quotas) setLimits(l Limits) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limits = l
+	q.total = newTokenBucket(l.TotalKbps * 1000)
+	for _, u := range q.users {
+		u.bucket = newTokenBucket(l.UserKbps * 1000)
+	}
+}
+
+func (q *quotas) user(name string) *userUsage {
+	u, ok := q.users[name]
+	if !ok {
+		u = &userUsage{bucket: newTokenBucket(q.limits.UserKbps * 1000)}
+		q.users[name] = u
+	}
+	return u
+}
+
+// Hold a slot for an authenticated Allocate request, or give the error to
+// reject it with
+func (q *quotas) reserve(m *stun.Message, from net.Addr) (stun.ErrorCode, bool) {
+	var username stun.Username
+	if err := username.GetFrom(m); err != nil {
+		return 0, true
+	}
+	name := turncred.UserID(username.String())
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.pending[m.TransactionID]; ok {
+		return 0, true // retransmission
+	}
+	now := time.Now()
+	userPending, totalPending := 0, 0
+	for id, p := range q.pending {
+		if now.Sub(p.at) > pendingAllocateTimeout {
+			delete(q.pending, id)
+			continue
+		}
+		totalPending++
+		if p.user == name {
+			userPending++
+		}
+	}
+
+	if n := q.limits.TotalAllocations; n > 0 && len(q.relays)+totalPending >= n {
+		quotaRejections.WithLabelValues("total_allocations").Inc()
+		allocationLog("quota_rejected", name, from).WithField("limit", n).Warn("Allocation refused: server allocation limit reached")
+		return stun.CodeAllocQuotaReached, false
+	}
+	if n := q.limits.UserAllocations; n > 0 && q.user(name).allocations+userPending >= n {
+		quotaRejections.WithLabelValues("user_allocations").Inc()
+		allocationLog("quota_rejected", name, from).WithField("limit", n).Warn("Allocation refused: user allocation limit reached")
+		return stun.CodeAllocQuotaReached, false
+	}
+	q.pending[m.TransactionID] = pendingAllocate{user: name, at: now}
+	return 0, true
+}
+
+// The server granted an allocation to client; charge its relay to the requesting user
+func (q *quotas) allocated(m *stun.Message, client net.Addr) {
+	var relayed stun.XORMappedAddress
+	if err := relayed.GetFromAs(m, stun.AttrXORRelayedAddress); err != nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p, ok := q.pending[m.TransactionID]
+	if !ok {
+		return
+	}
+	delete(q.pending, m.TransactionID)
+	if relay, ok := q.relays[relayed.String()]; ok && relay.user == "" {
+		relay.user = p.user
+		relay.client = client
+		relay.bytesIn = relayedBytes.WithLabelValues(p.user, "in")
+		relay.bytesOut = relayedBytes.WithLabelValues(p.user, "out")
+		q.user(p.user).allocations++
+	}
+}
+
+// The server refused an Allocate request
+func (q *quotas) release(m *stun.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, m.TransactionID)
+}
+
+func (q *quotas) register(relay *relayConn) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.relays[relay.relayed.String()] = relay
+}
+
+func (q *quotas) unregister(relay *relayConn) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.relays, relay.relayed.String())
+	if u, ok := q.users[relay.user]; ok && relay.user != "" {
+		u.allocations--
+		if u.allocations <= 0 {
+			delete(q.users, relay.user)
+			// Drop the user's series so minted user IDs do not pile up
+			relayedBytes.DeleteLabelValues(relay.user, "in")
+			relayedBytes.DeleteLabelValues(relay.user, "out")
+		}
+	}
+	allocationLog("allocation_deleted", relay.user, relay.client).
+		WithField("relay", relay.relayed.String()).Info("TURN allocation deleted")
+}
+
+// Allocations with an open relay socket
+func (q *quotas) active() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.relays)
+}
+
+// Charge n relayed bytes; false means drop the packet
+func (q *quotas) allow(user string, n int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// The user's bucket goes first so a throttled user's drops are not
+	// charged against everyone else's share of the total
+	now := time.Now()
+	var bucket *tokenBucket
+	if u, ok := q.users[user]; ok {
+		if !u.bucket.take(n, now) {
+			if now.Sub(u.throttled) >= throttleLogInterval {
+				u.throttled = now
+				logging.Logger.WithFields(logrus.Fields{"event": "throttled", "user": user, "limit_kbps": q.limits.UserKbps}).
+					Warn("Relayed bitrate over the user limit; dropping packets")
+			}
+			return false
+		}
+		bucket = u.bucket
+	}
+	if !q.total.take(n, now) {
+		bucket.refund(n)
+		return false
+	}
+	return true
+}
+
+// Relay address generator whose sockets count toward the quotas
+type quotaRelayGenerator struct {
+	turn.RelayAddressGenerator
+	quotas  *quotas
+	network string // udp6 for IPv6 relays; the server always asks for udp4
+}
+
+func (g *quotaRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	if g.network != "" {
+		network = g.network
+	}
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	relay := &relayConn{PacketConn: conn, relayed: addr, quotas: g.quotas}
+	g.quotas.register(relay)
+	return relay, addr, nil
+}
+
+// Relay socket of one allocation. Packets over the bitrate limits are dropped.
+type relayConn struct {
+	net.PacketConn
+	relayed net.Addr // public address clients are told
+	quotas  *quotas
+	once    sync.Once
+
+	// Set once the Allocate response is seen, guarded by quotas.mu
+	user     string
+	client   net.Addr
+	bytesIn  prometheus.Counter
+	bytesOut prometheus.Counter
+}
+
+func (c *relayConn) owner() (string, prometheus.Counter, prometheus.Counter) {
+	c.quotas.mu.Lock()
+	defer c.quotas.mu.Unlock()
+	return c.user, c.bytesIn, c.bytesOut
+}
+
+func (c *relayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		user, in, _ := c.owner()
+		if c.quotas.allow(user, n) {
+			if in != nil {
+				in.Add(float64(n))
+			}
+			return n, addr, nil
+		}
+	}
+}
+
+func (c *relayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	user, _, out := c.owner()
+	if !c.quotas.allow(user, len(p)) {
+		return len(p), nil
+	}
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if out != nil {
+		out.Add(float64(n))
+	}
+	return n, err
+}
+
+func (c *relayConn) Close() error {
+	c.once.Do(func() { c.quotas.unregister(c) })
+	return c.PacketConn.Close()
+}
+
+// tokenBucket allows rate bits per second with one second of burst
+type tokenBucket struct {
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bps int64) *tokenBucket {
+	if bps <= 0 {
+		return nil
+	}
+	rate := float64(bps) / 8
+	return &tokenBucket{rate: rate, tokens: rate}
+}
+
+// A nil bucket is unlimited
+func (b *tokenBucket) take(n int, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Give back n bytes taken for a packet that was dropped anyway
+func (b *tokenBucket) refund(n int) {
+	if b == nil {
+		return
+	}
+	b.tokens += float64(n)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
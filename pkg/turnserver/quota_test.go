@@ -0,0 +1,126 @@
+package turnserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+func allocateRequest(t *testing.T, username string) *stun.Message {
+	m, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		stun.NewUsername(username))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := newTokenBucket(8000) // 1000 bytes per second
+
+	if !b.take(1000, now) {
+		t.Fatal("a full bucket refused its rate")
+	}
+	if b.take(1, now) {
+		t.Error("an empty bucket gave a byte")
+	}
+	if !b.take(500, now.Add(500*time.Millisecond)) {
+		t.Error("half a second did not refill half the rate")
+	}
+	if b.take(1001, now.Add(time.Hour)) {
+		t.Error("refilled past one second of burst")
+	}
+
+	b.refund(5000)
+	if b.tokens != b.rate {
+		t.Errorf("refund filled the bucket to %v, want at most %v", b.tokens, b.rate)
+	}
+
+	var unlimited *tokenBucket
+	if !unlimited.take(1<<30, now) {
+		t.Error("a nil bucket refused")
+	}
+	unlimited.refund(1)
+}
+
+func TestAllowChargesUserFirst(t *testing.T) {
+	q := newQuotas(Limits{UserKbps: 8, TotalKbps: 16}) // 1000 and 2000 bytes per second
+	q.user("alice")
+	q.user("bob")
+
+	if !q.allow("alice", 1000) {
+		t.Fatal("alice refused within her limit")
+	}
+	// Over alice's limit: dropped without touching the total
+	for i := 0; i < 5; i++ {
+		if q.allow("alice", 1000) {
+			t.Fatal("alice allowed over her limit")
+		}
+	}
+	if !q.allow("bob", 1000) {
+		t.Error("bob refused: alice's drops were charged to the total")
+	}
+}
+
+func TestAllowRefundsUserWhenTotalIsFull(t *testing.T) {
+	q := newQuotas(Limits{UserKbps: 16, TotalKbps: 8}) // 2000 and 1000 bytes per second
+	q.user("alice")
+
+	if !q.allow("alice", 1000) {
+		t.Fatal("refused within both limits")
+	}
+	if q.allow("alice", 1000) {
+		t.Fatal("allowed over the total")
+	}
+	if tokens := q.users["alice"].bucket.tokens; tokens < 1000 {
+		t.Errorf("alice has %v bytes left; the packet the total dropped was charged to her", tokens)
+	}
+}
+
+func TestReserveAllocationLimits(t *testing.T) {
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+	q := newQuotas(Limits{UserAllocations: 1, TotalAllocations: 2})
+
+	first := allocateRequest(t, "1700003600:alice")
+	if _, ok := q.reserve(first, from); !ok {
+		t.Fatal("first allocation refused")
+	}
+	if _, ok := q.reserve(first, from); !ok {
+		t.Error("retransmission refused")
+	}
+	// Fresh credentials for the same user share its quota
+	code, ok := q.reserve(allocateRequest(t, "1700007200:alice"), from)
+	if ok || code != stun.CodeAllocQuotaReached {
+		t.Errorf("second alice allocation = %v, %v; want %v, false", code, ok, stun.CodeAllocQuotaReached)
+	}
+	if _, ok := q.reserve(allocateRequest(t, "1700003600:bob"), from); !ok {
+		t.Fatal("bob refused under the total")
+	}
+	if _, ok := q.reserve(allocateRequest(t, "1700003600:carol"), from); ok {
+		t.Error("carol allowed over the total")
+	}
+
+	q.release(first)
+	if _, ok := q.reserve(allocateRequest(t, "1700003600:alice"), from); !ok {
+		t.Error("alice refused after her refused Allocate released its slot")
+	}
+}
+
+func TestReserveIgnoresUnauthenticated(t *testing.T) {
+	q := newQuotas(Limits{TotalAllocations: 1})
+	m, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := q.reserve(m, nil); !ok {
+			t.Fatal("an unauthenticated request was charged")
+		}
+	}
+	if len(q.pending) != 0 {
+		t.Errorf("%d slots held for unauthenticated requests", len(q.pending))
+	}
+}
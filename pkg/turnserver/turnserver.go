@@ -0,0 +1,376 @@
+// Package turnserver runs a Pion TURN server with the policies the duress
+// service needs: minted or static credentials, per-user quotas, relay peer
+// filtering, metrics and an allocation event log. It backs both tools/turn
+// and the server's embedded TURN mode.
+package turnserver
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+
+	"github.com/pion/turn/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"webrtc-streaming/pkg/logging"
+)
+
+// Config is everything a TURN server runs with
+type Config struct {
+	Realm     string    `yaml:"realm"`
+	Listen    []Listen  `yaml:"listen"`
+	TLS       TLS       `yaml:"tls"`
+	Relays    []Relay   `yaml:"relays"`
+	PortRange PortRange `yaml:"portRange"`
+	Auth      Auth      `yaml:"auth"`
+	Limits    Limits    `yaml:"limits"`
+	Peers     Peers     `yaml:"peers"`
+}
+
+// Listen is one socket clients connect to, e.g. 0.0.0.0:3478 or [::]:3478
+type Listen struct {
+	Address  string `yaml:"address"`
+	Protocol string `yaml:"protocol"` // udp, tcp or tls
+}
+
+type TLS struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// Relay is a relay address pair: relay sockets bind LocalIP and clients are
+// told PublicIP, which differ on NAT'd hosts. Listeners use the pair whose
+// LocalIP is their own address, otherwise the first of their address family.
+type Relay struct {
+	PublicIP string `yaml:"publicIp"`
+	LocalIP  string `yaml:"localIp"` // default 0.0.0.0 or ::
+}
+
+type PortRange struct {
+	Min uint16 `yaml:"min"`
+	Max uint16 `yaml:"max"`
+}
+
+type Auth struct {
+	// Mode is "secret" (minted credentials only), "static" (users only) or
+	// "both"; empty picks whichever is configured
+	Mode   string            `yaml:"mode"`
+	Secret string            `yaml:"secret"`
+	Users  map[string]string `yaml:"users"`
+}
+
+// Limits caps concurrent allocations and relayed bitrate (both directions),
+// per user and across the server. Zero means unlimited.
+type Limits struct {
+	UserAllocations  int   `yaml:"userAllocations"`
+	TotalAllocations int   `yaml:"totalAllocations"`
+	UserKbps         int64 `yaml:"userKbps"`
+	TotalKbps        int64 `yaml:"totalKbps"`
+}
+
+// Peers are the CIDRs clients may and may not relay to; Allow wins
+type Peers struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// Default is a server on port 3478 (UDP and TCP) with the usual relay range
+// and limits; Relays and Auth must still be filled in
+func Default() Config {
+	return Config{
+		Realm: "duress",
+		Listen: []Listen{
+			{Address: "0.0.0.0:3478", Protocol: "udp"},
+			{Address: "0.0.0.0:3478", Protocol: "tcp"},
+		},
+		PortRange: PortRange{Min: 50000, Max: 55000},
+		Limits:    Limits{UserAllocations: 10, TotalAllocations: 4000},
+		Peers:     Peers{Deny: append([]string(nil), DefaultDeniedPeers...)},
+	}
+}
+
+// Validate reports the first setting that cannot work
+func (c *Config) Validate() error {
+	if c.Realm == "" {
+		return fmt.Errorf("realm: must be set")
+	}
+	if len(c.Relays) == 0 {
+		return fmt.Errorf("relays: at least one public IP is required")
+	}
+	for i, r := range c.Relays {
+		if net.ParseIP(r.PublicIP) == nil {
+			return fmt.Errorf("relays[%d].publicIp: %q is not an IP address", i, r.PublicIP)
+		}
+		if r.LocalIP != "" && net.ParseIP(r.LocalIP) == nil {
+			return fmt.Errorf("relays[%d].localIp: %q is not an IP address", i, r.LocalIP)
+		}
+	}
+	if c.PortRange.Min == 0 || c.PortRange.Max < c.PortRange.Min {
+		return fmt.Errorf("portRange: %d-%d is not a valid range", c.PortRange.Min, c.PortRange.Max)
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls: certFile and keyFile must be set together")
+	}
+	if len(c.Listen) == 0 {
+		return fmt.Errorf("listen: at least one address is required")
+	}
+	for i, l := range c.Listen {
+		host, _, err := net.SplitHostPort(l.Address)
+		if err != nil {
+			return fmt.Errorf("listen[%d].address: %v", i, err)
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("listen[%d].address: %q is not an IP address", i, host)
+		}
+		switch l.Protocol {
+		case "udp", "tcp":
+		case "tls":
+			if c.TLS.CertFile == "" {
+				return fmt.Errorf("listen[%d]: tls needs tls.certFile and tls.keyFile", i)
+			}
+		default:
+			return fmt.Errorf("listen[%d].protocol: %q is not udp, tcp or tls", i, l.Protocol)
+		}
+		if _, err := c.relayFor(l); err != nil {
+			return fmt.Errorf("listen[%d]: %v", i, err)
+		}
+	}
+
+	switch c.Auth.Mode {
+	case "":
+	case "secret":
+		if c.Auth.Secret == "" {
+			return fmt.Errorf("auth: mode secret needs auth.secret")
+		}
+	case "static":
+		if len(c.Auth.Users) == 0 {
+			return fmt.Errorf("auth: mode static needs auth.users")
+		}
+	case "both":
+	default:
+		return fmt.Errorf("auth.mode: %q is not secret, static or both", c.Auth.Mode)
+	}
+	if c.Auth.Secret == "" && len(c.Auth.Users) == 0 {
+		return fmt.Errorf("auth: a secret or static users are required")
+	}
+
+	if _, err := newPeerPolicy(c.Peers.Allow, c.Peers.Deny); err != nil {
+		return fmt.Errorf("peers: %v", err)
+	}
+	return nil
+}
+
+// The relay pair serving a listener
+func (c *Config) relayFor(l Listen) (Relay, error) {
+	host, _, _ := net.SplitHostPort(l.Address)
+	ip := net.ParseIP(host)
+	for _, r := range c.Relays {
+		if r.LocalIP != "" && net.ParseIP(r.LocalIP).Equal(ip) {
+			return r, nil
+		}
+	}
+	for _, r := range c.Relays {
+		if isIPv4(net.ParseIP(r.PublicIP)) == isIPv4(ip) {
+			return r, nil
+		}
+	}
+	return Relay{}, fmt.Errorf("no relay with the address family of %s", l.Address)
+}
+
+// URLs are the ICE server URLs clients reach the listeners on: turn: with
+// each relay's public IP for UDP and TCP, and turns: with tlsHost (the name
+// on the certificate) for TLS
+func (c *Config) URLs(tlsHost string) []string {
+	var urls []string
+	seen := map[string]bool{}
+	for _, l := range c.Listen {
+		r, err := c.relayFor(l)
+		if err != nil {
+			continue
+		}
+		_, port, _ := net.SplitHostPort(l.Address)
+		var url string
+		switch l.Protocol {
+		case "udp", "tcp":
+			url = "turn:" + net.JoinHostPort(r.PublicIP, port) + "?transport=" + l.Protocol
+		case "tls":
+			if tlsHost == "" {
+				continue
+			}
+			url = "turns:" + net.JoinHostPort(tlsHost, port) + "?transport=tcp"
+		}
+		if !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// Server is a running TURN server. Its metrics use the default Prometheus
+// registry; while two run in one process only the first exports its gauges.
+type Server struct {
+	cfg     Config
+	turn    *turn.Server
+	quotas  *quotas
+	peers   *peerPolicy
+	auth    *authenticator
+	metrics []prometheus.Collector // gauges, unregistered on Close
+}
+
+// Start listens on every configured address and serves until Close
+func Start(cfg Config) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	logger := logging.Logger
+
+	// All listeners share the quotas, peer policy and auth; each relay pair
+	// allocates from the same port range
+	s := &Server{cfg: cfg, quotas: newQuotas(cfg.Limits)}
+	var err error
+	if s.peers, err = newPeerPolicy(cfg.Peers.Allow, cfg.Peers.Deny); err != nil {
+		return nil, err
+	}
+	guard := &guard{quotas: s.quotas, peers: s.peers, events: newEvents()}
+	s.auth = newAuthenticator(cfg.Realm, guard.events)
+	guard.auth = s.auth
+	s.auth.update(cfg.Auth)
+
+	var certs *certReloader
+	if cfg.TLS.CertFile != "" {
+		if certs, err = newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile); err != nil {
+			return nil, fmt.Errorf("load TLS certificate: %v", err)
+		}
+	}
+
+	var closers []interface{ Close() error }
+	fail := func(err error) (*Server, error) {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+		return nil, err
+	}
+
+	relays := make(map[Relay]*quotaRelayGenerator)
+	serverConfig := turn.ServerConfig{
+		Realm:       cfg.Realm,
+		AuthHandler: s.auth.handle,
+	}
+	for _, l := range cfg.Listen {
+		r, _ := cfg.relayFor(l)
+		relay, ok := relays[r]
+		if !ok {
+			relay = newRelayGenerator(r, cfg.PortRange, s.quotas)
+			relays[r] = relay
+		}
+
+		if l.Protocol == "udp" {
+			conn, err := net.ListenPacket(network("udp", l.Address), l.Address)
+			if err != nil {
+				return fail(fmt.Errorf("listen udp %s: %v", l.Address, err))
+			}
+			closers = append(closers, conn)
+			serverConfig.PacketConnConfigs = append(serverConfig.PacketConnConfigs, turn.PacketConnConfig{
+				PacketConn:            &guardedPacketConn{PacketConn: conn, guard: guard},
+				RelayAddressGenerator: relay,
+			})
+		} else {
+			// Stream listeners for clients whose networks block UDP
+			var listener net.Listener
+			if l.Protocol == "tls" {
+				listener, err = listenTLS(network("tcp", l.Address), l.Address, certs)
+			} else {
+				listener, err = net.Listen(network("tcp", l.Address), l.Address)
+			}
+			if err != nil {
+				return fail(fmt.Errorf("listen %s %s: %v", l.Protocol, l.Address, err))
+			}
+			closers = append(closers, listener)
+			serverConfig.ListenerConfigs = append(serverConfig.ListenerConfigs, turn.ListenerConfig{
+				Listener:              &guardedListener{Listener: listener, guard: guard},
+				RelayAddressGenerator: relay,
+			})
+		}
+		logger.WithField("relay", r.PublicIP).Infof("TURN over %s on %s", l.Protocol, l.Address)
+	}
+
+	if s.turn, err = turn.NewServer(serverConfig); err != nil {
+		return fail(err)
+	}
+	s.metrics = registerMetrics(s.quotas, guard.events)
+	logger.Infof("TURN server started with realm '%s'", cfg.Realm)
+	return s, nil
+}
+
+// Reload applies new users, secret, limits and peer lists without dropping
+// allocations. It reports whether settings that need a restart changed.
+func (s *Server) Reload(cfg Config) (restart bool, err error) {
+	if err := cfg.Validate(); err != nil {
+		return false, err
+	}
+	if err := s.peers.update(cfg.Peers.Allow, cfg.Peers.Deny); err != nil {
+		return false, err
+	}
+	s.auth.update(cfg.Auth)
+	s.quotas.setLimits(cfg.Limits)
+	return !sameStartup(s.cfg, cfg), nil
+}
+
+// Close stops the server and its listeners
+func (s *Server) Close() error {
+	for _, c := range s.metrics {
+		prometheus.Unregister(c)
+	}
+	return s.turn.Close()
+}
+
+// Port range relay sockets for one relay pair, counted by the quotas
+func newRelayGenerator(r Relay, ports PortRange, quotas *quotas) *quotaRelayGenerator {
+	public := net.ParseIP(r.PublicIP)
+	local, udp := r.LocalIP, "udp4"
+	if !isIPv4(public) {
+		udp = "udp6"
+		if local == "" {
+			local = "::"
+		}
+	} else if local == "" {
+		local = "0.0.0.0"
+	}
+	if !isIPv4(net.ParseIP(local)) {
+		local = "[" + local + "]"
+	}
+	return &quotaRelayGenerator{
+		RelayAddressGenerator: &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: public,
+			Address:      local,
+			MinPort:      ports.Min,
+			MaxPort:      ports.Max,
+		},
+		quotas:  quotas,
+		network: udp,
+	}
+}
+
+// "udp4"/"tcp4" or "udp6"/"tcp6" for a listen address, so IPv4 and IPv6
+// sockets on the same port do not collide
+func network(proto, addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	if isIPv4(net.ParseIP(host)) {
+		return proto + "4"
+	}
+	return proto + "6"
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// Whether the settings that only apply at startup are unchanged
+func sameStartup(a, b Config) bool {
+	return a.Realm == b.Realm &&
+		reflect.DeepEqual(a.Listen, b.Listen) &&
+		reflect.DeepEqual(a.Relays, b.Relays) &&
+		a.PortRange == b.PortRange &&
+		a.TLS == b.TLS
+}
@@ -0,0 +1,117 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"webrtc-streaming/pkg/logging"
+)
+
+// Thresholds for switching a room to audio only on its own
+var (
+	AudioOnlyLossThreshold = 0.15                   // uplink packet loss fraction
+	AudioOnlyRTTThreshold  = 800 * time.Millisecond // broadcaster signaling round trip time
+	qualityCheckInterval   = 2 * time.Second
+)
+
+const (
+	degradedSamplesToEnter = 2 // consecutive bad samples before going audio only
+	healthySamplesToLeave  = 5 // consecutive good samples before restoring video
+)
+
+// Reasons reported with the audio-only event
+const (
+	AudioOnlyByBroadcaster = "broadcaster"
+	AudioOnlyByViewer      = "viewer"
+	AudioOnlyAuto          = "auto"
+)
+
+type audioOnlyEvent struct {
+	Enabled bool    `json:"enabled"`
+	Reason  string  `json:"reason"`
+	Loss    float64 `json:"loss,omitempty"`
+	RTTMs   int64   `json:"rttMs,omitempty"`
+}
+
+// AudioOnly reports whether video forwarding is suspended for the room
+func (r *Room) AudioOnly() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.audioOnly
+}
+
+// SetAudioOnly switches video forwarding off or on for every viewer and tells
+// all peers so the broadcaster can stop encoding video
+func (r *Room) SetAudioOnly(enabled bool, reason string) {
+	r.setAudioOnly(audioOnlyEvent{Enabled: enabled, Reason: reason})
+}
+
+func (r *Room) setAudioOnly(ev audioOnlyEvent) {
+	r.mu.Lock()
+	if r.audioOnly == ev.Enabled {
+		r.mu.Unlock()
+		return
+	}
+	r.audioOnly = ev.Enabled
+	r.audioOnlyReason = ev.Reason
+	r.mu.Unlock()
+
+	logging.Room(r.ID).WithFields(logrus.Fields{"enabled": ev.Enabled, "reason": ev.Reason}).Info("Room audio-only changed")
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		logging.Room(r.ID).WithError(err).Error("Marshal audio-only event error")
+		return
+	}
+	r.Peers.Broadcast("audio-only", string(data))
+	r.Peers.SignalPeerConnections(r)
+}
+
+// Parse the data of an audio-only request from a client: "on"/"off" or a boolean
+func parseAudioOnly(data string) (bool, bool) {
+	switch data {
+	case "on", "true", "1":
+		return true, true
+	case "off", "false", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// Watch the broadcaster's link and fall back to audio only while it is degraded.
+// Loss and RTT are the ones /stats reports for the broadcaster. Only automatic
+// fallbacks are undone automatically.
+func (r *Room) monitorQuality(conn PeerConnectionState) {
+	ticker := time.NewTicker(qualityCheckInterval)
+	defer ticker.Stop()
+
+	bad, good := 0, 0
+	for range ticker.C {
+		if conn.PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+
+		stats := conn.quality(r.Peers.trackList(), &conn.Media.monitorSample)
+		loss := stats.PacketLoss
+		rtt := time.Duration(stats.RTTMs * float64(time.Millisecond))
+
+		if loss > AudioOnlyLossThreshold || rtt > AudioOnlyRTTThreshold {
+			bad, good = bad+1, 0
+		} else if loss < AudioOnlyLossThreshold/3 && rtt < AudioOnlyRTTThreshold/2 {
+			bad, good = 0, good+1
+		}
+
+		r.mu.RLock()
+		enabled, reason := r.audioOnly, r.audioOnlyReason
+		r.mu.RUnlock()
+
+		switch {
+		case !enabled && bad >= degradedSamplesToEnter:
+			r.setAudioOnly(audioOnlyEvent{Enabled: true, Reason: AudioOnlyAuto, Loss: loss, RTTMs: rtt.Milliseconds()})
+		case enabled && reason == AudioOnlyAuto && good >= healthySamplesToLeave:
+			r.setAudioOnly(audioOnlyEvent{Enabled: false, Reason: AudioOnlyAuto, Loss: loss, RTTMs: rtt.Milliseconds()})
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// Bandwidth estimation bounds, in bits per second
+const (
+	initialEstimate    = 1000000
+	minEstimate        = 30000
+	maxEstimate        = 5000000
+	videoPauseBitrate  = 100000 // below this only audio is forwarded
+	videoResumeBitrate = 150000 // hysteresis so video does not flap
+)
+
+// bandwidthEstimator follows the loss-based half of GCC: back off when a viewer
+// reports heavy loss, probe up slowly when it reports almost none, and never
+// exceed the viewer's own REMB.
+type bandwidthEstimator struct {
+	mu        sync.Mutex
+	lossBased uint64
+	remb      uint64
+}
+
+func newBandwidthEstimator() *bandwidthEstimator {
+	return &bandwidthEstimator{lossBased: initialEstimate}
+}
+
+// OnREMB records the receiver's estimate and returns the combined one
+func (e *bandwidthEstimator) OnREMB(bps uint64) uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.remb = bps
+	return e.estimate()
+}
+
+// OnLoss applies a loss fraction (0..1) from a receiver report
+func (e *bandwidthEstimator) OnLoss(loss float64) uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch {
+	case loss > 0.10:
+		e.lossBased = uint64(float64(e.lossBased) * (1 - 0.5*loss))
+	case loss < 0.02:
+		e.lossBased = uint64(float64(e.lossBased)*1.05) + 1000
+	}
+	if e.lossBased < minEstimate {
+		e.lossBased = minEstimate
+	}
+	if e.lossBased > maxEstimate {
+		e.lossBased = maxEstimate
+	}
+	return e.estimate()
+}
+
+func (e *bandwidthEstimator) estimate() uint64 {
+	if e.remb > 0 && e.remb < e.lossBased {
+		return e.remb
+	}
+	return e.lossBased
+}
+
+// bandwidthDecision is reported to the viewer whenever it changes
+type bandwidthDecision struct {
+	Estimate    uint64 `json:"estimate"`
+	Layer       string `json:"layer,omitempty"`
+	VideoPaused bool   `json:"videoPaused"`
+}
+
+// Feed one sender's RTCP into the viewer's estimator. pion hands a compound
+// packet to every sender it names, so only the sender named first feeds the
+// estimator; the PeerConnection's estimate then moves once per packet.
+func (p *Peers) onSenderRTCP(conn PeerConnectionState, sender *webrtc.RTPSender, ssrc webrtc.SSRC, packets []rtcp.Packet) {
+	bwe := conn.Media.bwe
+	var estimate uint64
+	for _, pkt := range packets {
+		switch pkt := pkt.(type) {
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			if len(pkt.SSRCs) > 0 && pkt.SSRCs[0] == uint32(ssrc) {
+				estimate = bwe.OnREMB(pkt.Bitrate)
+			}
+		case *rtcp.ReceiverReport:
+			worst := -1.0
+			for _, report := range pkt.Reports {
+				if loss := float64(report.FractionLost) / 256; loss > worst {
+					worst = loss
+				}
+				if report.SSRC == uint32(ssrc) {
+					var clockRate uint32
+					if track, ok := sender.Track().(*ForwardTrack); ok {
+						clockRate = track.Codec().ClockRate
+					}
+					conn.Media.recordReport(ssrc, report, clockRate)
+				}
+			}
+			if len(pkt.Reports) > 0 && pkt.Reports[0].SSRC == uint32(ssrc) {
+				estimate = bwe.OnLoss(worst)
+			}
+		case *rtcp.TransportLayerNack:
+			if track, ok := sender.Track().(*ForwardTrack); ok {
+				for _, pair := range pkt.Nacks {
+					track.Retransmit(ssrc, pair.PacketList())
+				}
+			}
+		}
+	}
+	if estimate > 0 {
+		p.adaptToBandwidth(conn, estimate)
+	}
+}
+
+// Switch layers or pause video to fit the estimate, and tell the viewer
+func (p *Peers) adaptToBandwidth(conn PeerConnectionState, estimate uint64) {
+	layerChanged := conn.Media.SetEstimatedBitrate(estimate)
+
+	paused := conn.Media.VideoPaused()
+	pauseChanged := false
+	switch {
+	case !paused && estimate < videoPauseBitrate:
+		pauseChanged = p.setVideoPaused(conn, true)
+	case paused && estimate > videoResumeBitrate:
+		pauseChanged = p.setVideoPaused(conn, false)
+	}
+
+	if !layerChanged && !pauseChanged {
+		return
+	}
+
+	decision := bandwidthDecision{
+		Estimate:    estimate,
+		VideoPaused: conn.Media.VideoPaused(),
+	}
+	if !decision.VideoPaused {
+		decision.Layer = p.ApplyLayer(conn)
+	}
+	conn.Log.WithFields(logrus.Fields{
+		"estimate":    estimate,
+		"layer":       decision.Layer,
+		"videoPaused": decision.VideoPaused,
+	}).Info("Viewer bandwidth adapted")
+
+	data, err := json.Marshal(decision)
+	if err != nil {
+		conn.Log.WithError(err).Error("Marshal bandwidth decision error")
+		return
+	}
+	if err := conn.Websocket.Send(websocketMessage{
+		Event: "bandwidth",
+		Data:  string(data),
+	}); err != nil {
+		conn.Log.WithError(err).Error("Send bandwidth error")
+	}
+}
+
+// Detach or reattach a viewer's video senders without renegotiating; audio keeps flowing
+func (p *Peers) setVideoPaused(conn PeerConnectionState, paused bool) bool {
+	// Snapshot tracks first: sync takes ListLock before MediaState locks
+	p.ListLock.RLock()
+	locals := make(map[string]*ForwardTrack, len(p.TrackLocals))
+	for id, t := range p.TrackLocals {
+		locals[id] = t
+	}
+	p.ListLock.RUnlock()
+
+	m := conn.Media
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.videoPaused == paused {
+		return false
+	}
+	m.videoPaused = paused
+
+	if paused {
+		for _, sender := range conn.PeerConnection.GetSenders() {
+			track := sender.Track()
+			if track == nil || track.Kind() != webrtc.RTPCodecTypeVideo {
+				continue
+			}
+			if err := sender.ReplaceTrack(nil); err != nil {
+				conn.Log.WithError(err).Error("Pause video error")
+				continue
+			}
+			m.pausedVideo[sender] = track
+		}
+		return true
+	}
+
+	stale := false
+	for sender, track := range m.pausedVideo {
+		// The broadcaster may have replaced its tracks meanwhile; sync adds the new ones
+		if current, ok := locals[track.ID()]; ok && webrtc.TrackLocal(current) == track {
+			if err := sender.ReplaceTrack(track); err != nil {
+				conn.Log.WithError(err).Error("Resume video error")
+			}
+		} else {
+			stale = true
+		}
+		delete(m.pausedVideo, sender)
+	}
+	if stale && p.Room != nil {
+		// Not while holding the media lock: sync takes ListLock first
+		go p.SignalPeerConnections(p.Room)
+	}
+	return true
+}
@@ -0,0 +1,187 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Packets kept per source stream for retransmission, about 2s of 720p video
+const packetBufferSize = 512
+
+// packetBuffer is a ring of the most recent packets of one source stream,
+// keyed by sequence number. It also drops duplicates and packets that arrive
+// too late to be useful, and counts sequence gaps.
+type packetBuffer struct {
+	mu       sync.RWMutex
+	packets  [packetBufferSize]*rtp.Packet
+	started  bool
+	highest  uint16
+	received uint64
+	lost     uint64 // missing sequence numbers not (yet) filled by late packets
+
+	// RFC 3550 interarrival jitter, in clock units
+	clockRate   uint32
+	epoch       time.Time
+	lastTransit int64
+	jitter      float64
+}
+
+// Push stores pkt and reports whether it should be forwarded
+func (b *packetBuffer) Push(pkt *rtp.Packet) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	seq := pkt.SequenceNumber
+	slot := seq % packetBufferSize
+
+	switch diff := seq - b.highest; {
+	case !b.started:
+		b.started = true
+		b.highest = seq
+		b.updateJitter(pkt.Timestamp)
+	case diff == 0:
+		return false
+	case diff < 0x8000:
+		// Newer packet; forget whatever was stored for the skipped numbers
+		if diff > 1 {
+			b.lost += uint64(diff - 1)
+		}
+		for i, s := uint16(1), b.highest+1; i < diff && i <= packetBufferSize; i, s = i+1, s+1 {
+			b.packets[s%packetBufferSize] = nil
+		}
+		b.highest = seq
+		b.updateJitter(pkt.Timestamp)
+	default:
+		// Late packet: forward it if it is still inside the window and new to us
+		if b.highest-seq >= packetBufferSize {
+			return false
+		}
+		if old := b.packets[slot]; old != nil && old.SequenceNumber == seq {
+			return false
+		}
+		if b.lost > 0 {
+			b.lost--
+		}
+	}
+
+	b.packets[slot] = pkt
+	b.received++
+	return true
+}
+
+// Get returns the buffered packet with sequence number seq, if still held
+func (b *packetBuffer) Get(seq uint16) *rtp.Packet {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if !b.started || b.highest-seq >= packetBufferSize {
+		return nil
+	}
+	if pkt := b.packets[seq%packetBufferSize]; pkt != nil && pkt.SequenceNumber == seq {
+		return pkt
+	}
+	return nil
+}
+
+// Counts returns packets received and sequence numbers still missing
+func (b *packetBuffer) Counts() (received, lost uint64) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.received, b.lost
+}
+
+// Jitter returns the interarrival jitter of the stream
+func (b *packetBuffer) Jitter() time.Duration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.clockRate == 0 {
+		return 0
+	}
+	return time.Duration(b.jitter / float64(b.clockRate) * float64(time.Second))
+}
+
+// Callers must hold b.mu
+func (b *packetBuffer) updateJitter(ts uint32) {
+	if b.clockRate == 0 {
+		return
+	}
+	now := time.Now()
+	first := b.epoch.IsZero()
+	if first {
+		b.epoch = now
+	}
+	arrival := uint32(now.Sub(b.epoch).Seconds() * float64(b.clockRate))
+	transit := int64(int32(arrival - ts))
+	d := transit - b.lastTransit
+	b.lastTransit = transit
+	if first {
+		return
+	}
+	if d < 0 {
+		d = -d
+	}
+	b.jitter += (float64(d) - b.jitter) / 16
+}
+
+// rtpRewriter maps one or more source streams onto a single continuous output
+// stream. Offsets are recomputed whenever the source changes (a layer switch or
+// a replaced broadcaster track) so the viewer never sees sequence numbers or
+// timestamps jump. Not safe for concurrent use; ForwardTrack serialises access.
+type rtpRewriter struct {
+	clockRate  uint32
+	started    bool
+	resync     bool
+	seqOffset  uint16
+	tsOffset   uint32
+	epochStart uint16 // first output sequence number of the current source
+	lastSeq    uint16 // highest output sequence number written
+	lastTS     uint32
+	lastWrite  time.Time
+}
+
+// Resync makes the next packet continue the output stream from a new source
+func (r *rtpRewriter) Resync() {
+	r.resync = true
+}
+
+// Rewrite moves h into the output sequence and timestamp space
+func (r *rtpRewriter) Rewrite(h *rtp.Header) {
+	now := time.Now()
+
+	switch {
+	case !r.started:
+		r.started = true
+		r.epochStart = h.SequenceNumber
+		r.lastSeq = h.SequenceNumber - 1
+	case r.resync:
+		// Advance the clock by the wall time since the last packet
+		gap := uint32(now.Sub(r.lastWrite).Seconds() * float64(r.clockRate))
+		if gap == 0 {
+			gap = 1
+		}
+		r.seqOffset = r.lastSeq + 1 - h.SequenceNumber
+		r.tsOffset = r.lastTS + gap - h.Timestamp
+		r.epochStart = r.lastSeq + 1
+	}
+	r.resync = false
+
+	h.SequenceNumber += r.seqOffset
+	h.Timestamp += r.tsOffset
+
+	if diff := h.SequenceNumber - r.lastSeq; diff != 0 && diff < 0x8000 {
+		r.lastSeq = h.SequenceNumber
+		r.lastTS = h.Timestamp
+		r.lastWrite = now
+	}
+}
+
+// Source maps an output sequence number back to the current source stream.
+// Numbers sent before the last resync belong to an older source and cannot be served.
+func (r *rtpRewriter) Source(seq uint16) (uint16, bool) {
+	if !r.started || seq-r.epochStart > r.lastSeq-r.epochStart {
+		return 0, false
+	}
+	return seq - r.seqOffset, true
+}
@@ -0,0 +1,117 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func packet(seq uint16) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(seq) * 3000}}
+}
+
+func TestPacketBufferPush(t *testing.T) {
+	var b packetBuffer
+	steps := []struct {
+		seq      uint16
+		forward  bool
+		received uint64
+		lost     uint64
+	}{
+		{65534, true, 1, 0},
+		{65535, true, 2, 0},
+		{65535, false, 2, 0}, // duplicate
+		{2, true, 3, 2},      // wraps, 0 and 1 missing
+		{0, true, 4, 1},      // late but inside the window
+		{0, false, 4, 1},     // late duplicate
+		{3, true, 5, 1},
+		{65027, false, 5, 1}, // packetBufferSize behind, too late
+	}
+	for i, s := range steps {
+		if got := b.Push(packet(s.seq)); got != s.forward {
+			t.Errorf("step %d: Push(%d) = %v, want %v", i, s.seq, got, s.forward)
+		}
+		if received, lost := b.Counts(); received != s.received || lost != s.lost {
+			t.Errorf("step %d: Counts = %d, %d; want %d, %d", i, received, lost, s.received, s.lost)
+		}
+	}
+
+	for _, seq := range []uint16{65534, 65535, 0, 2, 3} {
+		if pkt := b.Get(seq); pkt == nil || pkt.SequenceNumber != seq {
+			t.Errorf("Get(%d) = %v", seq, pkt)
+		}
+	}
+	if pkt := b.Get(1); pkt != nil {
+		t.Errorf("Get(1) = %v, never received", pkt)
+	}
+}
+
+func TestPacketBufferForgetsOldSlots(t *testing.T) {
+	var b packetBuffer
+	b.Push(packet(10))
+	b.Push(packet(10 + packetBufferSize + 5)) // reuses every slot in between
+
+	if pkt := b.Get(10); pkt != nil {
+		t.Errorf("Get(10) = %v after the window moved on", pkt)
+	}
+	if pkt := b.Get(10 + packetBufferSize); pkt != nil {
+		t.Errorf("slot of a skipped number still holds %v", pkt)
+	}
+	if _, lost := b.Counts(); lost != packetBufferSize+4 {
+		t.Errorf("lost = %d", lost)
+	}
+}
+
+func TestRTPRewriter(t *testing.T) {
+	r := rtpRewriter{clockRate: 90000}
+	write := func(seq uint16, ts uint32) rtp.Header {
+		h := rtp.Header{SequenceNumber: seq, Timestamp: ts}
+		r.Rewrite(&h)
+		return h
+	}
+
+	// The first source passes through unchanged
+	for i := uint16(0); i < 3; i++ {
+		if h := write(100+i, 1000+uint32(i)*3000); h.SequenceNumber != 100+i || h.Timestamp != 1000+uint32(i)*3000 {
+			t.Fatalf("packet %d rewritten to %d/%d", i, h.SequenceNumber, h.Timestamp)
+		}
+	}
+
+	// A new source continues the output stream
+	r.Resync()
+	h := write(5000, 777)
+	if h.SequenceNumber != 103 {
+		t.Errorf("first packet after resync has seq %d, want 103", h.SequenceNumber)
+	}
+	if h.Timestamp <= 7000 {
+		t.Errorf("timestamp went from 7000 back to %d", h.Timestamp)
+	}
+	if h := write(5001, 3777); h.SequenceNumber != 104 {
+		t.Errorf("second packet after resync has seq %d, want 104", h.SequenceNumber)
+	}
+
+	// Retransmissions map back to the current source only
+	if src, ok := r.Source(104); !ok || src != 5001 {
+		t.Errorf("Source(104) = %d, %v; want 5001, true", src, ok)
+	}
+	if _, ok := r.Source(102); ok {
+		t.Error("Source(102) served from before the resync")
+	}
+	if _, ok := r.Source(105); ok {
+		t.Error("Source(105) served before it was sent")
+	}
+}
+
+func TestRTPRewriterWraps(t *testing.T) {
+	r := rtpRewriter{clockRate: 90000}
+	for _, seq := range []uint16{65534, 65535, 0, 1} {
+		h := rtp.Header{SequenceNumber: seq}
+		r.Rewrite(&h)
+	}
+	if src, ok := r.Source(65535); !ok || src != 65535 {
+		t.Errorf("Source(65535) = %d, %v", src, ok)
+	}
+	if src, ok := r.Source(1); !ok || src != 1 {
+		t.Errorf("Source(1) = %d, %v", src, ok)
+	}
+}
@@ -0,0 +1,58 @@
+package webrtc
+
+import (
+	"errors"
+
+	"github.com/pion/webrtc/v3"
+	"webrtc-streaming/pkg/signaling"
+)
+
+// Candidates a peer may send before its offer or answer
+const maxPendingCandidates = 64
+
+var errTooManyCandidates = errors.New("too many candidates before the remote description")
+
+// Remote ICE candidates that arrived before the remote description, held
+// until it is set. Used from a peer's WebSocket read loop only.
+type candidateQueue struct {
+	pending []webrtc.ICECandidateInit
+}
+
+// Apply c now, or hold it while the PeerConnection has no remote description
+func (q *candidateQueue) add(pc *webrtc.PeerConnection, c webrtc.ICECandidateInit) (queued bool, err error) {
+	if pc.RemoteDescription() != nil {
+		return false, pc.AddICECandidate(c)
+	}
+	if len(q.pending) >= maxPendingCandidates {
+		return false, errTooManyCandidates
+	}
+	q.pending = append(q.pending, c)
+	return true, nil
+}
+
+// Apply the held candidates once the remote description is set; returns how
+// many were applied and the first error
+func (q *candidateQueue) flush(pc *webrtc.PeerConnection) (int, error) {
+	pending := q.pending
+	q.pending = nil
+	var first error
+	applied := 0
+	for _, c := range pending {
+		if err := pc.AddICECandidate(c); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		applied++
+	}
+	return applied, first
+}
+
+// The error event for a candidate that could not be added
+func candidateError(err error) *signaling.Error {
+	if err == errTooManyCandidates {
+		return signaling.NewError(signaling.CodeCapacity, "candidate", "%v", err)
+	}
+	return signaling.NewError(signaling.CodeBadCandidate, "candidate", "%v", err)
+}
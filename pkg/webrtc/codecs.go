@@ -0,0 +1,254 @@
+package webrtc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// CodecPolicy controls which codecs are negotiated with broadcasters and viewers
+type CodecPolicy struct {
+	// Allowed video codecs in preference order: "H264", "VP8", "VP9"
+	Video []string `yaml:"video"`
+	// profile-level-id advertised for H264 (42e01f = constrained baseline 3.1)
+	H264ProfileLevelID string       `yaml:"h264ProfileLevelId"`
+	Opus               OpusSettings `yaml:"opus"`
+	// Close viewers that share no video codec with the broadcaster instead of
+	// falling back to audio only
+	RejectIncompatibleViewers bool `yaml:"rejectIncompatibleViewers"`
+}
+
+// OpusSettings maps onto the Opus fmtp line
+type OpusSettings struct {
+	Stereo            bool `yaml:"stereo"`
+	InbandFEC         bool `yaml:"fec"`
+	DTX               bool `yaml:"dtx"`
+	MaxAverageBitrate int  `yaml:"maxBitrate"` // bits per second, 0 leaves it to the encoder
+}
+
+// DefaultCodecPolicy prefers H264 baseline, which every Android hardware encoder can produce
+func DefaultCodecPolicy() CodecPolicy {
+	return CodecPolicy{
+		Video:              []string{"H264", "VP8", "VP9"},
+		H264ProfileLevelID: "42e01f",
+		Opus: OpusSettings{
+			InbandFEC: true,
+		},
+	}
+}
+
+// Codec policy applied to new peer connections
+var (
+	policyLock   sync.RWMutex
+	activePolicy = DefaultCodecPolicy()
+)
+
+// SetCodecPolicy validates the policy and applies it to peer connections
+// created from now on. Existing connections keep what they negotiated.
+func SetCodecPolicy(policy CodecPolicy) error {
+	if _, err := newMediaEngine(policy); err != nil {
+		return err
+	}
+
+	policyLock.Lock()
+	defer policyLock.Unlock()
+	activePolicy = policy
+	return nil
+}
+
+func codecPolicy() CodecPolicy {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	return activePolicy
+}
+
+// newPeerConnection creates a PeerConnection restricted to the active codec policy.
+// Interceptors keep per-stream state, so every connection gets its own registry.
+func newPeerConnection(config webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	m, err := newMediaEngine(codecPolicy())
+	if err != nil {
+		return nil, err
+	}
+
+	// RTCP reports and NACK generation towards the broadcaster come from pion;
+	// NACKs from viewers are answered by ForwardTrack from its own buffers
+	i := &interceptor.Registry{}
+	if err := webrtc.ConfigureRTCPReports(i); err != nil {
+		return nil, err
+	}
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	i.Add(generator)
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	return api.NewPeerConnection(config)
+}
+
+// Register only the allowed codecs, in preference order, so both the
+// broadcaster's offer and our offers to viewers are limited to them
+func newMediaEngine(policy CodecPolicy) (*webrtc.MediaEngine, error) {
+	if len(policy.Video) == 0 {
+		return nil, fmt.Errorf("codec policy: no video codecs allowed")
+	}
+
+	m := &webrtc.MediaEngine{}
+
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: policy.Opus.fmtp(),
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
+	feedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	seen := map[string]bool{}
+	for _, name := range policy.Video {
+		key := strings.ToUpper(name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		var codec webrtc.RTPCodecParameters
+		switch key {
+		case "H264":
+			profile := policy.H264ProfileLevelID
+			if profile == "" {
+				profile = "42e01f"
+			}
+			codec = webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:     webrtc.MimeTypeH264,
+					ClockRate:    90000,
+					SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile,
+					RTCPFeedback: feedback,
+				},
+				PayloadType: 102,
+			}
+		case "VP8":
+			codec = webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:     webrtc.MimeTypeVP8,
+					ClockRate:    90000,
+					RTCPFeedback: feedback,
+				},
+				PayloadType: 96,
+			}
+		case "VP9":
+			codec = webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:     webrtc.MimeTypeVP9,
+					ClockRate:    90000,
+					SDPFmtpLine:  "profile-id=0",
+					RTCPFeedback: feedback,
+				},
+				PayloadType: 98,
+			}
+		default:
+			return nil, fmt.Errorf("codec policy: unsupported video codec %q", name)
+		}
+
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	// RID and MID header extensions let broadcasters send simulcast video
+	for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (o OpusSettings) fmtp() string {
+	params := []string{"minptime=10", "useinbandfec=" + boolParam(o.InbandFEC)}
+	if o.Stereo {
+		params = append(params, "stereo=1", "sprop-stereo=1")
+	}
+	if o.DTX {
+		params = append(params, "usedtx=1")
+	}
+	if o.MaxAverageBitrate > 0 {
+		params = append(params, "maxaveragebitrate="+strconv.Itoa(o.MaxAverageBitrate))
+	}
+	return strings.Join(params, ";")
+}
+
+func boolParam(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// Check a viewer's answer against the codecs of the broadcaster's video tracks.
+// Returns the video codecs the viewer accepted so the caller can report them.
+func (p *Peers) viewerCodecsCompatible(answerSDP string) (bool, []string) {
+	p.ListLock.RLock()
+	needed := map[string]bool{}
+	for _, t := range p.TrackLocals {
+		if t.Kind() == webrtc.RTPCodecTypeVideo {
+			needed[strings.ToLower(t.Codec().MimeType)] = true
+		}
+	}
+	p.ListLock.RUnlock()
+
+	offered, err := videoCodecsInSDP(answerSDP)
+	if err != nil || len(needed) == 0 {
+		// malformed SDP is reported by SetRemoteDescription
+		return true, offered
+	}
+	for _, mime := range offered {
+		if needed[strings.ToLower(mime)] {
+			return true, offered
+		}
+	}
+	return false, offered
+}
+
+func videoCodecsInSDP(raw string) ([]string, error) {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(raw)); err != nil {
+		return nil, err
+	}
+
+	codecs := []string{}
+	seen := map[string]bool{}
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "video" || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		for _, attr := range media.Attributes {
+			if attr.Key != "rtpmap" {
+				continue
+			}
+			// "96 VP8/90000"
+			fields := strings.Fields(attr.Value)
+			if len(fields) != 2 {
+				continue
+			}
+			mime := "video/" + strings.Split(fields[1], "/")[0]
+			if !seen[mime] {
+				seen[mime] = true
+				codecs = append(codecs, mime)
+			}
+		}
+	}
+	return codecs, nil
+}
@@ -0,0 +1,148 @@
+package webrtc
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// HeartbeatConfig keeps signaling WebSockets honest: the server pings every
+// PingInterval and drops a socket that sends nothing, not even a pong or a
+// heartbeat event, for ReadTimeout. Writes give up after WriteTimeout.
+type HeartbeatConfig struct {
+	PingInterval time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+var (
+	heartbeatLock   sync.RWMutex
+	heartbeatConfig = HeartbeatConfig{
+		PingInterval: 15 * time.Second,
+		ReadTimeout:  45 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+)
+
+var heartbeatTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "signaling_heartbeat_timeouts_total",
+	Help: "Signaling WebSockets dropped after a missed heartbeat, by peer role.",
+}, []string{"role"})
+
+// SetHeartbeat sets the heartbeat used for every new signaling WebSocket
+func SetHeartbeat(cfg HeartbeatConfig) {
+	heartbeatLock.Lock()
+	defer heartbeatLock.Unlock()
+	heartbeatConfig = cfg
+}
+
+func currentHeartbeat() HeartbeatConfig {
+	heartbeatLock.RLock()
+	defer heartbeatLock.RUnlock()
+	return heartbeatConfig
+}
+
+// Heartbeat pings one WebSocket and keeps its read deadline moving while the
+// client is alive
+type Heartbeat struct {
+	conn *websocket.Conn
+	cfg  HeartbeatConfig
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+
+	mu     sync.Mutex
+	pinged time.Time // last ping not yet answered
+	onRTT  func(time.Duration)
+}
+
+// StartHeartbeat arms the read deadline and starts pinging c until Stop
+func StartHeartbeat(c *websocket.Conn) *Heartbeat {
+	h := &Heartbeat{conn: c, cfg: currentHeartbeat(), done: make(chan struct{})}
+	h.Alive()
+	c.SetPongHandler(func(string) error {
+		h.Alive()
+		h.pong()
+		return nil
+	})
+	if h.cfg.PingInterval > 0 {
+		h.wg.Add(1)
+		go h.ping()
+	}
+	return h
+}
+
+// Alive pushes the read deadline out; call it for every message received
+func (h *Heartbeat) Alive() {
+	if h.cfg.ReadTimeout > 0 {
+		_ = h.conn.SetReadDeadline(time.Now().Add(h.cfg.ReadTimeout))
+	}
+}
+
+// OnRTT calls fn with the round trip of every answered ping
+func (h *Heartbeat) OnRTT(fn func(time.Duration)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onRTT = fn
+}
+
+func (h *Heartbeat) pong() {
+	h.mu.Lock()
+	pinged, fn := h.pinged, h.onRTT
+	h.pinged = time.Time{}
+	h.mu.Unlock()
+	if !pinged.IsZero() && fn != nil {
+		fn(time.Since(pinged))
+	}
+}
+
+// Stop ends the pings and waits for the last one, as the socket is recycled
+// once its handler returns; the socket itself is left to its owner
+func (h *Heartbeat) Stop() {
+	h.once.Do(func() { close(h.done) })
+	h.wg.Wait()
+}
+
+func (h *Heartbeat) ping() {
+	defer h.wg.Done()
+	ticker := time.NewTicker(h.cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			// Control frames may be written alongside other writes
+			deadline := time.Now().Add(h.cfg.PingInterval)
+			h.mu.Lock()
+			h.pinged = time.Now()
+			h.mu.Unlock()
+			if err := h.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// HeartbeatMissed reports whether a read failed because the client went
+// quiet for longer than the read timeout, and counts it for role
+func HeartbeatMissed(err error, role string) bool {
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() {
+		return false
+	}
+	heartbeatTimeouts.WithLabelValues(role).Inc()
+	return true
+}
+
+// Write deadline for a single message, or none when disabled
+func writeDeadline() time.Time {
+	if d := currentHeartbeat().WriteTimeout; d > 0 {
+		return time.Now().Add(d)
+	}
+	return time.Time{}
+}
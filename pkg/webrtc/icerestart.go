@@ -0,0 +1,109 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ICE restarts tried before a failed PeerConnection is closed
+var (
+	iceRestartLock sync.RWMutex
+	maxICERestarts = 3
+)
+
+var iceRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sfu_ice_restarts_total",
+	Help: "ICE restarts by peer role and who started them (server or client).",
+}, []string{"role", "initiator"})
+
+// SetMaxICERestarts sets how many ICE restarts the server attempts for a
+// disconnected or failed PeerConnection before closing it
+func SetMaxICERestarts(n int) {
+	iceRestartLock.Lock()
+	defer iceRestartLock.Unlock()
+	maxICERestarts = n
+}
+
+// Restart bookkeeping for one PeerConnection
+type iceRestarter struct {
+	mu       sync.Mutex
+	attempts int
+	max      int
+}
+
+func newICERestarter() *iceRestarter {
+	iceRestartLock.RLock()
+	defer iceRestartLock.RUnlock()
+	return &iceRestarter{max: maxICERestarts}
+}
+
+// Decide how to react to a connection state: restart ICE now, or give up and
+// close. Disconnected often heals by itself, so it only triggers the first
+// restart; Failed uses up the rest.
+func (r *iceRestarter) onState(state webrtc.PeerConnectionState) (restart bool, attempt int, giveUp bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		r.attempts = 0
+	case webrtc.PeerConnectionStateDisconnected:
+		if r.attempts == 0 && r.max > 0 {
+			r.attempts++
+			return true, r.attempts, false
+		}
+	case webrtc.PeerConnectionStateFailed:
+		if r.attempts < r.max {
+			r.attempts++
+			return true, r.attempts, false
+		}
+		return false, r.attempts, true
+	}
+	return false, r.attempts, false
+}
+
+// Send a viewer a new offer with fresh ICE credentials
+func (p *Peers) restartViewerICE(conn PeerConnectionState) error {
+	p.ListLock.Lock()
+	defer p.ListLock.Unlock()
+
+	offer, err := conn.PeerConnection.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return err
+	}
+	if err := conn.PeerConnection.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	offerString, err := json.Marshal(offer)
+	if err != nil {
+		return err
+	}
+	return conn.Websocket.Send(websocketMessage{
+		Event: "offer",
+		Data:  string(offerString),
+	})
+}
+
+// Whether an offer from the broadcaster restarts ICE, i.e. carries a new
+// ice-ufrag compared to the current remote description
+func isICERestartOffer(pc *webrtc.PeerConnection, sdp string) bool {
+	current := pc.CurrentRemoteDescription()
+	if current == nil {
+		return false
+	}
+	ufrag := iceUfrag(sdp)
+	return ufrag != "" && ufrag != iceUfrag(current.SDP)
+}
+
+func iceUfrag(sdp string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		if strings.HasPrefix(line, "a=ice-ufrag:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "a=ice-ufrag:"))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,96 @@
+package webrtc
+
+import (
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SFU metrics, registered with the default Prometheus registry
+var (
+	pcStateTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfu_peer_connection_state_transitions_total",
+		Help: "PeerConnection state changes by peer role and new state.",
+	}, []string{"role", "state"})
+
+	renegotiations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfu_renegotiations_total",
+		Help: "Offers sent to peers while syncing tracks, by peer role.",
+	}, []string{"role"})
+
+	forwardedPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfu_forwarded_rtp_packets_total",
+		Help: "RTP packets received from broadcasters and forwarded, by room and track.",
+	}, []string{"room", "track", "kind"})
+
+	forwardedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfu_forwarded_rtp_bytes_total",
+		Help: "RTP payload bytes received from broadcasters and forwarded, by room and track.",
+	}, []string{"room", "track", "kind"})
+)
+
+func init() {
+	prometheus.MustRegister(roomCollector{
+		rooms: prometheus.NewDesc("sfu_rooms_active", "Rooms in the SFU registry.", nil, nil),
+		peers: prometheus.NewDesc("sfu_peers", "Connected peers by role.", []string{"role"}, nil),
+	})
+}
+
+// roomCollector reads room and peer counts from the registry at scrape time
+type roomCollector struct {
+	rooms *prometheus.Desc
+	peers *prometheus.Desc
+}
+
+func (c roomCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.rooms
+	ch <- c.peers
+}
+
+func (c roomCollector) Collect(ch chan<- prometheus.Metric) {
+	RoomsLock.RLock()
+	rooms := make([]*Room, 0, len(Rooms))
+	for _, room := range Rooms {
+		if room != nil {
+			rooms = append(rooms, room)
+		}
+	}
+	RoomsLock.RUnlock()
+
+	roles := map[string]int{"broadcaster": 0, "viewer": 0}
+	for _, room := range rooms {
+		room.Peers.ListLock.RLock()
+		for _, conn := range room.Peers.Connections {
+			roles[conn.Role]++
+		}
+		room.Peers.ListLock.RUnlock()
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.rooms, prometheus.GaugeValue, float64(len(rooms)))
+	for role, n := range roles {
+		ch <- prometheus.MustNewConstMetric(c.peers, prometheus.GaugeValue, float64(n), role)
+	}
+}
+
+// Forwarding counters for one local track
+type trackMetrics struct {
+	labels  []string
+	packets prometheus.Counter
+	bytes   prometheus.Counter
+}
+
+func newTrackMetrics(roomID, id string, kind webrtc.RTPCodecType) trackMetrics {
+	labels := []string{roomID, id, kind.String()}
+	return trackMetrics{
+		labels:  labels,
+		packets: forwardedPackets.WithLabelValues(labels...),
+		bytes:   forwardedBytes.WithLabelValues(labels...),
+	}
+}
+
+// Drop a removed track's series so track IDs do not pile up; another room's
+// track with the same ID keeps its own
+func (m trackMetrics) delete() {
+	forwardedPackets.DeleteLabelValues(m.labels...)
+	forwardedBytes.DeleteLabelValues(m.labels...)
+}
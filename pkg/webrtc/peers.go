@@ -2,13 +2,15 @@ package webrtc
 
 import (
     "encoding/json"
-    "log"
+    "strings"
     "sync"
     "time"
 
     "github.com/gofiber/websocket/v2"
     "github.com/pion/rtcp"
     "github.com/pion/webrtc/v3"
+    "github.com/sirupsen/logrus"
+    "webrtc-streaming/pkg/signaling"
 )
 
 // Global room registry
@@ -19,18 +21,30 @@ var (
     ActiveRoomID string
 )
 
-// TURN/STUN configuration
-var turnConfig = webrtc.Configuration{
-    ICETransportPolicy: webrtc.ICETransportPolicyRelay,
-    ICEServers: []webrtc.ICEServer{
-        {URLs: []string{"stun:turn.localhost:3478"}},
-        {
-            URLs:           []string{"turn:turn.localhost:3478"},
-            Username:       "akhil",
-            Credential:     "sharma",
-            CredentialType: webrtc.ICECredentialTypePassword,
-        },
-    },
+// ICE servers and transport policy for new PeerConnections
+var (
+    rtcConfigLock sync.RWMutex
+    rtcConfigFunc = func() webrtc.Configuration { return webrtc.Configuration{} }
+)
+
+// SetRTCConfiguration sets the ICE configuration used for every new PeerConnection
+func SetRTCConfiguration(config webrtc.Configuration) {
+    SetRTCConfigurationFunc(func() webrtc.Configuration { return config })
+}
+
+// SetRTCConfigurationFunc builds the configuration per PeerConnection, e.g. to
+// mint fresh TURN credentials for each one
+func SetRTCConfigurationFunc(fn func() webrtc.Configuration) {
+    rtcConfigLock.Lock()
+    defer rtcConfigLock.Unlock()
+    rtcConfigFunc = fn
+}
+
+func rtcConfiguration() webrtc.Configuration {
+    rtcConfigLock.RLock()
+    fn := rtcConfigFunc
+    rtcConfigLock.RUnlock()
+    return fn()
 }
 
 // Peer management
@@ -38,53 +52,249 @@ type Peers struct {
     Room        *Room
     ListLock    sync.RWMutex
     Connections []PeerConnectionState
-    TrackLocals map[string]*webrtc.TrackLocalStaticRTP
+    TrackLocals map[string]*ForwardTrack
 }
 
 type PeerConnectionState struct {
+    ID             string
     PeerConnection *webrtc.PeerConnection
     Websocket      *ThreadSafeWriter
     Role           string
+    Name           string // display name from ?name=, for presence events
+    Media          *MediaState
+    Log            *logrus.Entry // tagged with room, role and connection ID
+}
+
+// Per-peer forwarding decisions, shared by every copy of a PeerConnectionState
+type MediaState struct {
+    mu            sync.RWMutex
+    videoDisabled bool
+    layer         string // explicit simulcast layer, empty for automatic
+    estimate      uint64 // estimated downlink bandwidth in bps
+    bwe           *bandwidthEstimator
+    videoPaused   bool
+    pausedVideo   map[*webrtc.RTPSender]webrtc.TrackLocal
+    ssrcs         map[*webrtc.RTPSender]webrtc.SSRC // read once, while the sender has a track
+    reports       map[webrtc.SSRC]receiverReport // latest viewer report per sender
+    sample        qualitySample // last /stats poll
+    monitorSample qualitySample // last audio-only check, kept apart so polls don't shorten its window
+    signalingRTT  time.Duration // last ping round trip on the signaling socket
+}
+
+func newMediaState() *MediaState {
+    return &MediaState{
+        bwe:         newBandwidthEstimator(),
+        pausedVideo: make(map[*webrtc.RTPSender]webrtc.TrackLocal),
+        ssrcs:       make(map[*webrtc.RTPSender]webrtc.SSRC),
+    }
+}
+
+// Add track to pc and remember the new sender's SSRC. GetParameters needs the
+// sender's track, so mu is held to keep a pause from replacing it first.
+func (m *MediaState) addSender(pc *webrtc.PeerConnection, track webrtc.TrackLocal) (*webrtc.RTPSender, webrtc.SSRC, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    sender, err := pc.AddTrack(track)
+    if err != nil {
+        return nil, 0, err
+    }
+    ssrc := sender.GetParameters().Encodings[0].SSRC
+    m.ssrcs[sender] = ssrc
+    return sender, ssrc, nil
+}
+
+func (m *MediaState) removeSender(sender *webrtc.RTPSender) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    delete(m.ssrcs, sender)
+}
+
+// SSRC of a sender added with addSender, whether or not it has a track now
+func (m *MediaState) senderSSRC(sender *webrtc.RTPSender) (webrtc.SSRC, bool) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    ssrc, ok := m.ssrcs[sender]
+    return ssrc, ok
+}
+
+func (m *MediaState) VideoDisabled() bool {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    return m.videoDisabled
+}
+
+func (m *MediaState) DisableVideo() {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.videoDisabled = true
+}
+
+// Video held back because the viewer's bandwidth is too low
+func (m *MediaState) VideoPaused() bool {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    return m.videoPaused
+}
+
+// Simulcast layer this peer should receive: the explicit choice if any,
+// otherwise whatever fits the bandwidth estimate
+func (m *MediaState) Layer() string {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    if m.layer != "" {
+        return m.layer
+    }
+    return m.autoLayer()
+}
+
+// Layer for the current estimate; the top one until there is an estimate
+func (m *MediaState) autoLayer() string {
+    if m.estimate > 0 {
+        return layerForBitrate(m.estimate)
+    }
+    return simulcastLayers[len(simulcastLayers)-1]
+}
+
+// Pin a layer ("q", "h", "f"), or "auto" to follow the bandwidth estimate
+func (m *MediaState) SetLayer(rid string) bool {
+    if rid == "auto" {
+        rid = ""
+    }
+    if rid != "" && !validLayer(rid) {
+        return false
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.layer = rid
+    return true
+}
+
+// Record a bandwidth estimate; reports whether the automatic layer changed
+func (m *MediaState) SetEstimatedBitrate(bps uint64) bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    before := m.autoLayer()
+    m.estimate = bps
+    return m.layer == "" && m.autoLayer() != before
 }
 
 type ThreadSafeWriter struct {
     Conn  *websocket.Conn
     Mutex sync.Mutex
+    Codec signaling.Codec // the client's protocol version
+}
+
+// NewWriter negotiates the signaling version for c and greets v1 clients
+func NewWriter(c *websocket.Conn) *ThreadSafeWriter {
+    t := &ThreadSafeWriter{Conn: c, Codec: signaling.Negotiate(c)}
+    if hello, ok := t.Codec.Hello(); ok {
+        _ = t.Send(hello)
+    }
+    return t
+}
+
+// Close ends the conversation with a WebSocket close code and reason; the
+// handler still closes the socket when it returns
+func (t *ThreadSafeWriter) Close(code int, reason string) error {
+    if len(reason) > 123 {
+        reason = reason[:123] // the limit for a close frame
+    }
+    return t.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+}
+
+// Fail tells the client why with an error event, then closes with code
+func (t *ThreadSafeWriter) Fail(e *signaling.Error, code int) {
+    _ = t.Send(e.Event())
+    _ = t.Close(code, e.Message)
+}
+
+// Send writes a signaling message in the client's protocol version; events
+// its version has no use for are skipped
+func (t *ThreadSafeWriter) Send(m signaling.Message) error {
+    frame, ok := t.Codec.Encode(m)
+    if !ok {
+        return nil
+    }
+    return t.WriteJSON(frame)
 }
 
 func (t *ThreadSafeWriter) WriteJSON(v interface{}) error {
     t.Mutex.Lock()
     defer t.Mutex.Unlock()
+    // A stalled client must not hold the writer (and its callers) forever
+    _ = t.Conn.SetWriteDeadline(writeDeadline())
     return t.Conn.WriteJSON(v)
 }
 
-// Add remote track and trigger sync
-func (p *Peers) AddTrack(t *webrtc.TrackRemote, room *Room) *webrtc.TrackLocalStaticRTP {
+// Add remote track (or one simulcast layer of it) and trigger sync.
+// A track ID seen before keeps its local track so viewers continue seamlessly.
+func (p *Peers) AddTrack(t *webrtc.TrackRemote, source *webrtc.PeerConnection, room *Room) *ForwardTrack {
     p.ListLock.Lock()
-    defer func() {
-        p.ListLock.Unlock()
-        p.SignalPeerConnections(room)
-    }()
-
-    trackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, t.ID(), t.StreamID())
-    if err != nil {
-        log.Println("AddTrack error:", err)
-        return nil
+    if p.TrackLocals == nil {
+        p.TrackLocals = make(map[string]*ForwardTrack)
     }
+    trackLocal, exists := p.TrackLocals[t.ID()]
+    if exists && !strings.EqualFold(trackLocal.Codec().MimeType, t.Codec().MimeType) {
+        exists = false
+    }
+    if !exists {
+        trackLocal = newForwardTrack(t, room.ID)
+        p.TrackLocals[t.ID()] = trackLocal
+    }
+    p.ListLock.Unlock()
 
-    p.TrackLocals[t.ID()] = trackLocal
+    trackLocal.addLayer(t, source)
+    if !exists {
+        p.SignalPeerConnections(room)
+    }
     return trackLocal
 }
 
-// Remove track and trigger sync
-func (p *Peers) RemoveTrack(t *webrtc.TrackLocalStaticRTP, room *Room) {
+// Remove one stream of a track; the track goes away with its last layer
+func (p *Peers) RemoveTrack(t *ForwardTrack, remote *webrtc.TrackRemote, room *Room) {
+    if t.removeLayer(remote.RID(), remote) {
+        return
+    }
+
     p.ListLock.Lock()
-    defer func() {
-        p.ListLock.Unlock()
-        p.SignalPeerConnections(room)
-    }()
+    if p.TrackLocals[t.ID()] == t {
+        delete(p.TrackLocals, t.ID())
+        t.metrics.delete()
+    }
+    p.ListLock.Unlock()
+    p.SignalPeerConnections(room)
+}
+
+// Point every simulcast sender of a peer at the layer it should receive
+func (p *Peers) ApplyLayer(conn PeerConnectionState) string {
+    rid := conn.Media.Layer()
+    selected := ""
+    for _, sender := range conn.PeerConnection.GetSenders() {
+        track, ok := sender.Track().(*ForwardTrack)
+        if !ok {
+            continue
+        }
+        ssrc, ok := conn.Media.senderSSRC(sender)
+        if !ok {
+            continue
+        }
+        if l := track.SelectLayer(ssrc, rid); l != "" {
+            selected = l
+        }
+    }
+    return selected
+}
 
-    delete(p.TrackLocals, t.ID())
+// Drain RTCP from a sender so interceptors run, and feed the viewer's bandwidth estimator
+func (p *Peers) readSenderRTCP(conn PeerConnectionState, sender *webrtc.RTPSender, ssrc webrtc.SSRC) {
+    for {
+        packets, _, err := sender.ReadRTCP()
+        if err != nil {
+            return
+        }
+        p.onSenderRTCP(conn, sender, ssrc, packets)
+    }
 }
 
 // Sync peer connections with current tracks
@@ -96,24 +306,36 @@ func (p *Peers) SignalPeerConnections(room *Room) {
     }()
 
     attemptSync := func() bool {
+        audioOnly := room.AudioOnly()
         for i := range p.Connections {
             pc := p.Connections[i].PeerConnection
 
             if pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+                p.Connections[i].Log.Info("Removed closed connection")
                 p.Connections = append(p.Connections[:i], p.Connections[i+1:]...)
-                log.Println("Removed closed connection")
                 return true
             }
 
+            // The broadcaster makes its own offers; offering to it would collide
+            if p.Connections[i].Role == "broadcaster" {
+                continue
+            }
+
+            videoDisabled := p.Connections[i].Media.VideoDisabled() ||
+                (audioOnly && p.Connections[i].Role == "viewer")
+            videoPaused := p.Connections[i].Media.VideoPaused()
+
             existingSenders := map[string]bool{}
             for _, sender := range pc.GetSenders() {
                 if sender.Track() != nil {
                     existingSenders[sender.Track().ID()] = true
-                    if _, ok := p.TrackLocals[sender.Track().ID()]; !ok {
+                    _, ok := p.TrackLocals[sender.Track().ID()]
+                    if !ok || (videoDisabled && sender.Track().Kind() == webrtc.RTPCodecTypeVideo) {
                         if err := pc.RemoveTrack(sender); err != nil {
-                            log.Println("RemoveTrack error:", err)
+                            p.Connections[i].Log.WithError(err).Error("RemoveTrack error")
                             return true
                         }
+                        p.Connections[i].Media.removeSender(sender)
                     }
                 }
             }
@@ -124,56 +346,83 @@ func (p *Peers) SignalPeerConnections(room *Room) {
                 }
             }
 
-            for trackID := range p.TrackLocals {
+            for trackID, track := range p.TrackLocals {
+                if (videoDisabled || videoPaused) && track.Kind() == webrtc.RTPCodecTypeVideo {
+                    continue
+                }
                 if !existingSenders[trackID] {
-                    if _, err := pc.AddTrack(p.TrackLocals[trackID]); err != nil {
-                        log.Println("AddTrack error:", err)
+                    sender, ssrc, err := p.Connections[i].Media.addSender(pc, track)
+                    if err != nil {
+                        p.Connections[i].Log.WithError(err).Error("AddTrack error")
                         return true
                     }
+                    go p.readSenderRTCP(p.Connections[i], sender, ssrc)
                 }
             }
 
             offer, err := pc.CreateOffer(nil)
             if err != nil {
-                log.Println("CreateOffer error:", err)
+                p.Connections[i].Log.WithError(err).Error("CreateOffer error")
                 return true
             }
 
             if err = pc.SetLocalDescription(offer); err != nil {
-                log.Println("SetLocalDescription error:", err)
+                p.Connections[i].Log.WithError(err).Error("SetLocalDescription error")
                 return true
             }
 
             offerString, err := json.Marshal(offer)
             if err != nil {
-                log.Println("Marshal offer error:", err)
+                p.Connections[i].Log.WithError(err).Error("Marshal offer error")
                 return true
             }
 
+            // Each viewer gets the offer for its own PeerConnection only; ListLock
+            // is held, so BroadcastTo cannot be used here anyway
             room.LastOffer = string(offerString)
-            p.BroadcastTo("viewer", "offer", room.LastOffer)
 
-            if err = p.Connections[i].Websocket.WriteJSON(&websocketMessage{
+            if err = p.Connections[i].Websocket.Send(websocketMessage{
                 Event: "offer",
                 Data:  room.LastOffer,
             }); err != nil {
-                log.Println("Send offer error:", err)
+                p.Connections[i].Log.WithError(err).Error("Send offer error")
                 return true
             }
+            renegotiations.WithLabelValues(p.Connections[i].Role).Inc()
         }
         return false
     }
 
-    for attempt := 0; attempt < 25; attempt++ {
+    for attempt := 0; ; attempt++ {
+        if attempt == 25 {
+            // Still failing; release the lock and try again later
+            go func() {
+                time.Sleep(3 * time.Second)
+                p.SignalPeerConnections(room)
+            }()
+            return
+        }
         if !attemptSync() {
             break
         }
     }
+}
 
-    go func() {
-        time.Sleep(3 * time.Second)
-        p.SignalPeerConnections(room)
-    }()
+// How often viewers get a fresh keyframe without asking for one
+const keyFrameInterval = 3 * time.Second
+
+// Request keyframes every keyFrameInterval until pc closes, so viewers that
+// lost packets or joined mid-stream recover on their own
+func (p *Peers) dispatchKeyFrames(pc *webrtc.PeerConnection) {
+    ticker := time.NewTicker(keyFrameInterval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        if pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+            return
+        }
+        p.DispatchKeyFrame()
+    }
 }
 
 // Request keyframes from all receivers
@@ -183,10 +432,11 @@ func (p *Peers) DispatchKeyFrame() {
 
     for _, conn := range p.Connections {
         for _, receiver := range conn.PeerConnection.GetReceivers() {
-            if receiver.Track() != nil {
+            // Simulcast receivers hold one track per layer
+            for _, track := range receiver.Tracks() {
                 _ = conn.PeerConnection.WriteRTCP([]rtcp.Packet{
                     &rtcp.PictureLossIndication{
-                        MediaSSRC: uint32(receiver.Track().SSRC()),
+                        MediaSSRC: uint32(track.SSRC()),
                     },
                 })
             }
@@ -200,7 +450,7 @@ func (p *Peers) Broadcast(event, data string) {
     defer p.ListLock.RUnlock()
 
     for _, conn := range p.Connections {
-        _ = conn.Websocket.WriteJSON(&websocketMessage{
+        _ = conn.Websocket.Send(websocketMessage{
             Event: event,
             Data:  data,
         })
@@ -214,7 +464,7 @@ func (p *Peers) BroadcastTo(role, event, data string) {
 
     for _, conn := range p.Connections {
         if conn.Role == role {
-            _ = conn.Websocket.WriteJSON(&websocketMessage{
+            _ = conn.Websocket.Send(websocketMessage{
                 Event: event,
                 Data:  data,
             })
@@ -247,8 +497,5 @@ func (p *Peers) GetConnectionStats() map[string]interface{} {
     }
 }
 
-// WebSocket message format
-type websocketMessage struct {
-    Event string `json:"event"`
-    Data  string `json:"data"`
-}
+// WebSocket message format, translated per client by its codec
+type websocketMessage = signaling.Message
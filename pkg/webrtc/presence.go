@@ -0,0 +1,39 @@
+package webrtc
+
+import (
+	"github.com/pion/webrtc/v3"
+	"webrtc-streaming/pkg/signaling"
+)
+
+func (conn PeerConnectionState) participant() signaling.Participant {
+	return signaling.Participant{Role: conn.Role, Name: conn.Name, ID: conn.ID}
+}
+
+// Send conn the roster of the room and announce it to everyone else. Call
+// once conn is registered.
+func (p *Peers) join(conn PeerConnectionState) {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	var others []signaling.Participant
+	for _, other := range p.Connections {
+		if other.ID == conn.ID || other.PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			continue
+		}
+		others = append(others, other.participant())
+		_ = other.Websocket.Send(signaling.Joined(conn.participant()))
+	}
+	_ = conn.Websocket.Send(signaling.Roster(others))
+}
+
+// Tell everyone else in the room that conn is gone
+func (p *Peers) leave(conn PeerConnectionState) {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	for _, other := range p.Connections {
+		if other.ID != conn.ID {
+			_ = other.Websocket.Send(signaling.Left(conn.participant()))
+		}
+	}
+}
@@ -1,31 +1,44 @@
 package webrtc
 
 import (
+	"context"
 	"encoding/json"
-	"log"
-	"os"
 	"sync"
 
 	"github.com/gofiber/websocket/v2"
 	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"webrtc-streaming/pkg/logging"
+	"webrtc-streaming/pkg/signaling"
 )
 
 // Room represents a WebRTC session
 type Room struct {
+	ID        string
 	Peers     *Peers
 	LastOffer string
+
+	mu              sync.RWMutex
+	audioOnly       bool
+	audioOnlyReason string
 }
 
 // Handles a broadcaster (victim) WebSocket
-func RoomConn(c *websocket.Conn, p *Peers, room *Room) {
-	config := webrtc.Configuration{}
-	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
-		config = turnConfig
-	}
+func RoomConn(ctx context.Context, c *websocket.Conn, p *Peers, room *Room) {
+	id := newPeerID("broadcaster")
+	ws := NewWriter(c)
+	logger := logging.FromContext(ctx).WithFields(logrus.Fields{
+		logging.RoomID: room.ID,
+		logging.Role:   "broadcaster",
+		logging.ConnID: id,
+	})
 
-	pc, err := webrtc.NewPeerConnection(config)
+	pc, err := newPeerConnection(rtcConfiguration())
 	if err != nil {
-		log.Println("PeerConnection creation failed:", err)
+		logger.WithError(err).Error("PeerConnection creation failed")
+		ws.Fail(signaling.NewError(signaling.CodeInternal, "", "could not create a PeerConnection"), signaling.CloseInternal)
 		return
 	}
 	defer pc.Close()
@@ -35,75 +48,99 @@ func RoomConn(c *websocket.Conn, p *Peers, room *Room) {
 		if _, err := pc.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
 			Direction: webrtc.RTPTransceiverDirectionRecvonly,
 		}); err != nil {
-			log.Println("AddTransceiver error:", err)
+			logger.WithError(err).Error("AddTransceiver error")
+			ws.Fail(signaling.NewError(signaling.CodeInternal, "", "could not set up media"), signaling.CloseInternal)
 			return
 		}
 	}
 
 	newPeer := PeerConnectionState{
+		ID:             id,
 		PeerConnection: pc,
-		Websocket: &ThreadSafeWriter{
-			Conn:  c,
-			Mutex: sync.Mutex{},
-		},
-		Role: "broadcaster",
+		Websocket:      ws,
+		Role:           "broadcaster",
+		Name:           c.Query("name"),
+		Media:          newMediaState(),
+		Log:            logger,
 	}
 
+	span := startPeerSpan(ctx, newPeer)
+	defer span.End()
+
 	// Register peer
 	p.ListLock.Lock()
 	p.Connections = append(p.Connections, newPeer)
 	p.ListLock.Unlock()
-	log.Println("New broadcaster connected. Total peers:", len(p.Connections))
+	logger.WithField("peers", len(p.Connections)).Info("Broadcaster connected")
+	p.join(newPeer)
+	defer p.leave(newPeer)
 
 	// Send ICE candidates to broadcaster as JSON
 	pc.OnICECandidate(func(i *webrtc.ICECandidate) {
 		if i == nil {
+			_ = ws.Send(websocketMessage{Event: "end-of-candidates"})
 			return
 		}
 		candJSON, err := json.Marshal(i.ToJSON())
 		if err != nil {
-			log.Println("ICE candidate marshal error:", err)
+			logger.WithError(err).Error("ICE candidate marshal error")
 			return
 		}
-		if err := newPeer.Websocket.WriteJSON(&websocketMessage{
+		if err := ws.Send(websocketMessage{
 			Event: "candidate",
 			Data:  string(candJSON),
 		}); err != nil {
-			log.Println("Send candidate error:", err)
+			logger.WithError(err).Error("Send candidate error")
 		}
 	})
 
+	// The broadcaster makes the offers, so the server asks it to restart ICE
+	restarts := newICERestarter()
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		log.Printf("Broadcaster PC state: %s", state.String())
-		switch state {
-		case webrtc.PeerConnectionStateFailed:
-			_ = pc.Close()
-		case webrtc.PeerConnectionStateClosed:
+		logger.WithField("state", state.String()).Info("Broadcaster PC state changed")
+		pcStateTransitions.WithLabelValues("broadcaster", state.String()).Inc()
+		span.AddEvent("connection state", trace.WithAttributes(attribute.String("state", state.String())))
+		if state == webrtc.PeerConnectionStateClosed {
 			p.SignalPeerConnections(room)
+			return
+		}
+		restart, attempt, giveUp := restarts.onState(state)
+		if restart {
+			logger.WithField("attempt", attempt).Warn("Asking broadcaster for an ICE restart")
+			iceRestarts.WithLabelValues("broadcaster", "server").Inc()
+			if err := ws.Send(websocketMessage{Event: "ice-restart"}); err != nil {
+				logger.WithError(err).Error("Send ice-restart error")
+			}
+		}
+		if giveUp {
+			logger.WithField("attempts", attempt).Warn("ICE restarts exhausted; closing broadcaster")
+			_ = pc.Close()
+			// The client's close reply ends the read loop
+			ws.Fail(signaling.NewError(signaling.CodeICEFailed, "", "ICE failed after %d restarts", attempt), signaling.CloseInternal)
 		}
 	})
 
 	// Forward incoming media to TrackLocals
 	pc.OnTrack(func(t *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
-		log.Printf("Received broadcaster track: %s (%s)", t.ID(), t.Kind().String())
+		trackLog := logger.WithFields(logrus.Fields{"track": t.ID(), "kind": t.Kind().String()})
+		trackLog.Info("Received broadcaster track")
 
-		trackLocal := p.AddTrack(t, room)
-		if trackLocal == nil {
-			log.Println("Failed to create local track")
-			return
+		// Simulcast sends one OnTrack per RID layer; all feed the same local track
+		if t.RID() != "" {
+			trackLog = trackLog.WithField("rid", t.RID())
+			trackLog.Debug("Simulcast layer received")
 		}
-		defer p.RemoveTrack(trackLocal, room)
+		trackLocal := p.AddTrack(t, pc, room)
+		defer p.RemoveTrack(trackLocal, t, room)
 
-		buf := make([]byte, 1500)
 		for {
-			n, _, err := t.Read(buf)
+			pkt, _, err := t.ReadRTP()
 			if err != nil {
-				log.Println("Remote track read error:", err)
+				trackLog.WithError(err).Info("Remote track ended")
 				return
 			}
-			if _, err = trackLocal.Write(buf[:n]); err != nil {
-				log.Println("Local track write error:", err)
-				return
+			if err = trackLocal.WriteRTP(t.RID(), pkt); err != nil {
+				trackLog.WithError(err).Warn("Local track write error")
 			}
 		}
 	})
@@ -111,18 +148,33 @@ func RoomConn(c *websocket.Conn, p *Peers, room *Room) {
 	// After the broadcaster is ready, try to sync viewers
 	p.SignalPeerConnections(room)
 
-	// Handle incoming WS messages
+	// Handle incoming WS messages; a client that stops answering pings is
+	// dropped and the viewers told
+	hb := StartHeartbeat(c)
+	defer hb.Stop()
+	hb.OnRTT(newPeer.Media.SetSignalingRTT)
+	go room.monitorQuality(newPeer)
+	go p.dispatchKeyFrames(pc)
+	var candidates candidateQueue
 	for {
 		_, raw, err := c.ReadMessage()
 		if err != nil {
-			log.Println("Broadcaster WS read error:", err)
+			if HeartbeatMissed(err, "broadcaster") {
+				logger.Warn("Broadcaster missed heartbeat; disconnecting")
+				_ = ws.Close(signaling.CloseGoingAway, "heartbeat missed")
+				p.BroadcastTo("viewer", "peer-disconnected", "broadcaster")
+				return
+			}
+			logger.WithError(err).Info("Broadcaster WS closed")
 			return
 		}
+		hb.Alive()
 
-		var msg websocketMessage
-		if err := json.Unmarshal(raw, &msg); err != nil {
-			log.Println("Broadcaster WS unmarshal error:", err)
-			return
+		msg, verr := ws.Codec.Decode(raw)
+		if verr != nil {
+			logger.WithError(verr).Warn("Rejected broadcaster message")
+			_ = ws.Send(verr.Event())
+			continue
 		}
 
 		switch msg.Event {
@@ -133,42 +185,95 @@ func RoomConn(c *websocket.Conn, p *Peers, room *Room) {
 				// fallback: treat as plain candidate string
 				candInit = webrtc.ICECandidateInit{Candidate: msg.Data}
 			}
-			if err := pc.AddICECandidate(candInit); err != nil {
-				log.Println("AddICECandidate error:", err)
-				return
+			queued, err := candidates.add(pc, candInit)
+			traceSignal(span, msg.Event, err)
+			if err != nil {
+				logger.WithError(err).Warn("AddICECandidate error")
+				_ = ws.Send(candidateError(err).Event())
+				continue
+			}
+			if queued {
+				logger.Debug("Candidate held until the offer arrives")
 			}
 
 		case "offer":
 			// Android sends plain SDP string for offer
 			offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: msg.Data}
+			if isICERestartOffer(pc, msg.Data) {
+				logger.Info("Broadcaster restarted ICE")
+				iceRestarts.WithLabelValues("broadcaster", "client").Inc()
+			}
 			if err := pc.SetRemoteDescription(offer); err != nil {
-				log.Println("SetRemoteDescription(offer) error:", err)
-				return
+				// The previous description still stands, so the client may offer again
+				traceSignal(span, msg.Event, err)
+				logger.WithError(err).Warn("SetRemoteDescription(offer) error")
+				_ = ws.Send(signaling.NewError(signaling.CodeInvalidSDP, msg.Event, "%v", err).Event())
+				continue
+			}
+			if n, err := candidates.flush(pc); err != nil {
+				logger.WithError(err).Warn("Early candidate rejected")
+			} else if n > 0 {
+				logger.WithField("candidates", n).Debug("Applied early candidates")
 			}
 			answer, err := pc.CreateAnswer(nil)
 			if err != nil {
-				log.Println("CreateAnswer error:", err)
+				traceSignal(span, msg.Event, err)
+				logger.WithError(err).Error("CreateAnswer error")
+				ws.Fail(signaling.NewError(signaling.CodeInternal, msg.Event, "could not create an answer"), signaling.CloseInternal)
 				return
 			}
 			if err := pc.SetLocalDescription(answer); err != nil {
-				log.Println("SetLocalDescription(answer) error:", err)
+				traceSignal(span, msg.Event, err)
+				logger.WithError(err).Error("SetLocalDescription(answer) error")
+				ws.Fail(signaling.NewError(signaling.CodeInternal, msg.Event, "could not apply the answer"), signaling.CloseInternal)
 				return
 			}
 			// Send back plain SDP string
-			if err := newPeer.Websocket.WriteJSON(&websocketMessage{
+			err = ws.Send(websocketMessage{
 				Event: "answer",
 				Data:  answer.SDP,
-			}); err != nil {
-				log.Println("Send answer error:", err)
+			})
+			traceSignal(span, msg.Event, err)
+			if err != nil {
+				logger.WithError(err).Error("Send answer error")
 				return
 			}
 
 		case "answer":
 			// Not expected from broadcaster
-			log.Println("Unexpected answer from broadcaster; ignoring")
+			logger.Warn("Unexpected answer from broadcaster; ignoring")
+
+		case "audio-only":
+			enabled, ok := parseAudioOnly(msg.Data)
+			if !ok {
+				logger.WithField("value", msg.Data).Warn("Invalid audio-only value from broadcaster")
+				continue
+			}
+			room.SetAudioOnly(enabled, AudioOnlyByBroadcaster)
+
+		case "end-of-candidates":
+			logger.Debug("Broadcaster finished gathering candidates")
+
+		case "bye":
+			logger.WithField("reason", msg.Data).Info("Broadcaster said bye")
+			_ = pc.Close()
+			_ = ws.Close(signaling.CloseNormal, "bye")
+			return
+
+		case "error":
+			logger.WithField("error", msg.Data).Warn("Broadcaster reported an error")
+
+		case "heartbeat":
+			// Application-level keepalive for clients that cannot see pings
+			if err := ws.Send(websocketMessage{
+				Event: "heartbeat-ack",
+				Data:  msg.Data,
+			}); err != nil {
+				logger.WithError(err).Error("Send heartbeat-ack error")
+			}
 
 		default:
-			log.Println("Unknown event from broadcaster:", msg.Event)
+			logger.WithField("event", msg.Event).Warn("Unknown event from broadcaster")
 		}
 	}
 }
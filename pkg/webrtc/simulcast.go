@@ -0,0 +1,121 @@
+package webrtc
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Simulcast layers by RID, lowest quality first
+var simulcastLayers = []string{"q", "h", "f"}
+
+// Rough bitrate each layer needs, used to pick a layer from a bandwidth estimate
+var layerBitrates = map[string]uint64{
+	"q": 150000,
+	"h": 500000,
+	"f": 1500000,
+}
+
+func validLayer(rid string) bool {
+	for _, l := range simulcastLayers {
+		if l == rid {
+			return true
+		}
+	}
+	return false
+}
+
+func layerIndex(rid string) int {
+	for i, l := range simulcastLayers {
+		if l == rid {
+			return i
+		}
+	}
+	return len(simulcastLayers) - 1
+}
+
+// layerForBitrate picks the highest layer that fits the estimated bandwidth
+func layerForBitrate(bps uint64) string {
+	layer := simulcastLayers[0]
+	for _, rid := range simulcastLayers {
+		if layerBitrates[rid] <= bps {
+			layer = rid
+		}
+	}
+	return layer
+}
+
+// Detect the start of a keyframe so layer switches land on a decodable frame
+func isKeyFrame(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return isVP8KeyFrame(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		// I|P|L|F|B|E|V|Z: not inter-predicted and start of frame
+		return len(payload) > 0 && payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264KeyFrame(payload)
+	}
+	return true
+}
+
+func isVP8KeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// X|R|N|S|R|PID; keyframes only matter at the start of partition 0
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+	offset := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		offset++
+		if ext&0x80 != 0 { // PictureID
+			if len(payload) <= offset {
+				return false
+			}
+			if payload[offset]&0x80 != 0 {
+				offset += 2
+			} else {
+				offset++
+			}
+		}
+		if ext&0x40 != 0 { // TL0PICIDX
+			offset++
+		}
+		if ext&0x30 != 0 { // TID/KEYIDX
+			offset++
+		}
+	}
+	// P bit of the VP8 payload header is 0 for keyframes
+	return len(payload) > offset && payload[offset]&0x01 == 0
+}
+
+func isH264KeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch nalType := payload[0] & 0x1F; nalType {
+	case 5, 7: // IDR, SPS
+		return true
+	case 24: // STAP-A
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if offset >= len(payload) {
+				break
+			}
+			if t := payload[offset] & 0x1F; t == 5 || t == 7 {
+				return true
+			}
+			offset += size
+		}
+	case 28: // FU-A, first fragment of an IDR
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1F == 5
+	}
+	return false
+}
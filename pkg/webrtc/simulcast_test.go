@@ -0,0 +1,78 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestLayerForBitrate(t *testing.T) {
+	tests := []struct {
+		bps  uint64
+		want string
+	}{
+		{0, "q"},
+		{149999, "q"},
+		{150000, "q"},
+		{499999, "q"},
+		{500000, "h"},
+		{1499999, "h"},
+		{1500000, "f"},
+		{maxEstimate, "f"},
+	}
+	for _, tt := range tests {
+		if got := layerForBitrate(tt.bps); got != tt.want {
+			t.Errorf("layerForBitrate(%d) = %q, want %q", tt.bps, got, tt.want)
+		}
+	}
+}
+
+func TestAutoLayerWithoutEstimate(t *testing.T) {
+	m := newMediaState()
+	if got := m.Layer(); got != "f" {
+		t.Fatalf("Layer() = %q before any estimate, want f", got)
+	}
+	if m.SetEstimatedBitrate(2000000) {
+		t.Error("f to f reported as a change")
+	}
+	if !m.SetEstimatedBitrate(200000) {
+		t.Error("f to q not reported")
+	}
+}
+
+func TestIsKeyFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		mime    string
+		payload []byte
+		want    bool
+	}{
+		{"vp8 key", webrtc.MimeTypeVP8, []byte{0x10, 0x00}, true},
+		{"vp8 delta", webrtc.MimeTypeVP8, []byte{0x10, 0x01}, false},
+		{"vp8 key with picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x23, 0x00}, true},
+		{"vp8 key with all extensions", webrtc.MimeTypeVP8, []byte{0x90, 0xF0, 0x05, 0x01, 0x20, 0x00}, true},
+		{"vp8 not partition start", webrtc.MimeTypeVP8, []byte{0x00, 0x00}, false},
+		{"vp8 later partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00}, false},
+		{"vp8 truncated", webrtc.MimeTypeVP8, []byte{0x90, 0x80}, false},
+		{"vp8 empty", webrtc.MimeTypeVP8, nil, false},
+		{"vp9 key", webrtc.MimeTypeVP9, []byte{0x08}, true},
+		{"vp9 inter", webrtc.MimeTypeVP9, []byte{0x48}, false},
+		{"vp9 not frame start", webrtc.MimeTypeVP9, []byte{0x00}, false},
+		{"h264 idr", webrtc.MimeTypeH264, []byte{0x65}, true},
+		{"h264 sps", webrtc.MimeTypeH264, []byte{0x67}, true},
+		{"h264 non-idr", webrtc.MimeTypeH264, []byte{0x41}, false},
+		{"h264 stap-a with sps", webrtc.MimeTypeH264, []byte{0x18, 0x00, 0x02, 0x67, 0x42, 0x00, 0x01, 0x68}, true},
+		{"h264 stap-a second idr", webrtc.MimeTypeH264, []byte{0x18, 0x00, 0x01, 0x06, 0x00, 0x01, 0x65}, true},
+		{"h264 stap-a without idr", webrtc.MimeTypeH264, []byte{0x18, 0x00, 0x01, 0x41}, false},
+		{"h264 fu-a idr start", webrtc.MimeTypeH264, []byte{0x7C, 0x85}, true},
+		{"h264 fu-a idr middle", webrtc.MimeTypeH264, []byte{0x7C, 0x05}, false},
+		{"h264 fu-a non-idr start", webrtc.MimeTypeH264, []byte{0x7C, 0x81}, false},
+		{"mime case", "video/vp8", []byte{0x10, 0x00}, true},
+		{"audio", webrtc.MimeTypeOpus, []byte{0x00}, true},
+	}
+	for _, tt := range tests {
+		if got := isKeyFrame(tt.mime, tt.payload); got != tt.want {
+			t.Errorf("%s: isKeyFrame = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package webrtc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Rates are recomputed at most this often, however frequently stats are polled
+const minStatsInterval = time.Second
+
+// RoomStats is the live quality of every connection in a room
+type RoomStats struct {
+	RoomID    string      `json:"roomId"`
+	AudioOnly bool        `json:"audioOnly"`
+	Tracks    int         `json:"tracks"`
+	Peers     []PeerStats `json:"peers"`
+}
+
+// PeerStats describes one PeerConnectionState. Loss, jitter and frame rate are
+// measured on what the server receives from a broadcaster and on what a viewer
+// reports receiving from the server.
+type PeerStats struct {
+	ID              string         `json:"id"`
+	Role            string         `json:"role"`
+	ConnectionState string         `json:"connectionState"`
+	ICEState        string         `json:"iceState"`
+	CandidatePair   *CandidatePair `json:"candidatePair,omitempty"`
+	RTTMs           float64        `json:"rttMs"`
+	JitterMs        float64        `json:"jitterMs"`
+	PacketLoss      float64        `json:"packetLoss"`
+	BitrateIn       uint64         `json:"bitrateIn"`
+	BitrateOut      uint64         `json:"bitrateOut"`
+	FPS             float64        `json:"fps"`
+	Layer           string         `json:"layer,omitempty"`
+	VideoPaused     bool           `json:"videoPaused"`
+}
+
+// CandidatePair is the ICE route in use: host, srflx, prflx or relay on each end
+type CandidatePair struct {
+	Local    string `json:"local"`
+	Remote   string `json:"remote"`
+	Protocol string `json:"protocol"`
+	Relay    string `json:"relayProtocol,omitempty"`
+}
+
+// Latest report block a viewer sent for one of its senders
+type receiverReport struct {
+	loss   float64
+	jitter time.Duration
+	rtt    time.Duration
+}
+
+// Counters at the last rate computation, and the rates derived from them
+type qualitySample struct {
+	at         time.Time
+	bytesIn    uint64
+	bytesOut   uint64
+	frames     uint64
+	layers     map[string]uint64 // broadcaster frames by track and layer
+	received   uint64
+	lost       uint64
+	bitrateIn  uint64
+	bitrateOut uint64
+	fps        float64
+	loss       float64
+}
+
+func newPeerID(role string) string {
+	return fmt.Sprintf("%s-%d", role, time.Now().UnixNano())
+}
+
+// Stats collects the live quality of every connection in the room
+func (r *Room) Stats(roomID string) RoomStats {
+	r.Peers.ListLock.RLock()
+	conns := make([]PeerConnectionState, len(r.Peers.Connections))
+	copy(conns, r.Peers.Connections)
+	r.Peers.ListLock.RUnlock()
+	tracks := r.Peers.trackList()
+
+	stats := RoomStats{
+		RoomID:    roomID,
+		AudioOnly: r.AudioOnly(),
+		Tracks:    len(tracks),
+		Peers:     make([]PeerStats, 0, len(conns)),
+	}
+	for _, conn := range conns {
+		stats.Peers = append(stats.Peers, conn.quality(tracks, &conn.Media.sample))
+	}
+	return stats
+}
+
+// Snapshot of the room's forwarded tracks
+func (p *Peers) trackList() []*ForwardTrack {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+	tracks := make([]*ForwardTrack, 0, len(p.TrackLocals))
+	for _, t := range p.TrackLocals {
+		tracks = append(tracks, t)
+	}
+	return tracks
+}
+
+// quality measures rates since the sample in last, which it then replaces;
+// last must be a field of conn.Media, guarded by its mu
+func (conn PeerConnectionState) quality(tracks []*ForwardTrack, last *qualitySample) PeerStats {
+	pc := conn.PeerConnection
+	ps := PeerStats{
+		ID:              conn.ID,
+		Role:            conn.Role,
+		ConnectionState: pc.ConnectionState().String(),
+		ICEState:        pc.ICEConnectionState().String(),
+	}
+
+	report := pc.GetStats()
+	cur := qualitySample{at: time.Now()}
+	if transport, ok := report["iceTransport"].(webrtc.TransportStats); ok {
+		cur.bytesIn, cur.bytesOut = transport.BytesReceived, transport.BytesSent
+	}
+	ps.CandidatePair = selectedPair(report)
+
+	if conn.Role == "broadcaster" {
+		cur.layers = make(map[string]uint64)
+		// The server sends a broadcaster no media, so no report block carries
+		// its RTT; the signaling ping stands in
+		ps.RTTMs = durationMs(conn.Media.SignalingRTT())
+		var jitter time.Duration
+		for _, t := range tracks {
+			st, ok := t.sourceStats(pc)
+			if !ok {
+				continue
+			}
+			cur.received += st.Received
+			cur.lost += st.Lost
+			for rid, frames := range st.Frames {
+				cur.layers[t.ID()+"/"+rid] = frames
+			}
+			if st.Jitter > jitter {
+				jitter = st.Jitter
+			}
+		}
+		ps.JitterMs = durationMs(jitter)
+	} else {
+		for _, sender := range pc.GetSenders() {
+			t, ok := sender.Track().(*ForwardTrack)
+			if !ok {
+				continue
+			}
+			if ssrc, ok := conn.Media.senderSSRC(sender); ok {
+				cur.frames += t.framesSent(ssrc)
+			}
+		}
+		loss, jitter, rtt := conn.Media.worstReport()
+		ps.JitterMs = durationMs(jitter)
+		ps.RTTMs = durationMs(rtt)
+		ps.Layer = conn.Media.Layer()
+		ps.VideoPaused = conn.Media.VideoPaused()
+		cur.loss = loss
+	}
+
+	sample := conn.Media.updateSample(last, cur, conn.Role == "broadcaster")
+	ps.BitrateIn, ps.BitrateOut = sample.bitrateIn, sample.bitrateOut
+	ps.FPS = sample.fps
+	ps.PacketLoss = sample.loss
+	return ps
+}
+
+// The nominated pair and the types of its two candidates
+func selectedPair(report webrtc.StatsReport) *CandidatePair {
+	for _, s := range report {
+		pair, ok := s.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated || pair.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+		local, _ := report[pair.LocalCandidateID].(webrtc.ICECandidateStats)
+		remote, _ := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats)
+		return &CandidatePair{
+			Local:    local.CandidateType.String(),
+			Remote:   remote.CandidateType.String(),
+			Protocol: local.Protocol,
+			Relay:    local.RelayProtocol,
+		}
+	}
+	return nil
+}
+
+// Record a viewer's report block for the sender with ssrc
+func (m *MediaState) recordReport(ssrc webrtc.SSRC, report rtcp.ReceptionReport, clockRate uint32) {
+	r := receiverReport{
+		loss: float64(report.FractionLost) / 256,
+		rtt:  reportRTT(report, time.Now()),
+	}
+	if clockRate > 0 {
+		r.jitter = time.Duration(float64(report.Jitter) / float64(clockRate) * float64(time.Second))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.reports == nil {
+		m.reports = make(map[webrtc.SSRC]receiverReport)
+	}
+	m.reports[ssrc] = r
+}
+
+// SetSignalingRTT records a round trip measured on the signaling socket
+func (m *MediaState) SetSignalingRTT(rtt time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signalingRTT = rtt
+}
+
+// SignalingRTT is the last round trip measured on the signaling socket
+func (m *MediaState) SignalingRTT() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.signalingRTT
+}
+
+// Worst loss and jitter across a viewer's senders, and the latest RTT
+func (m *MediaState) worstReport() (loss float64, jitter, rtt time.Duration) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, r := range m.reports {
+		if r.loss > loss {
+			loss = r.loss
+		}
+		if r.jitter > jitter {
+			jitter = r.jitter
+		}
+		if r.rtt > rtt {
+			rtt = r.rtt
+		}
+	}
+	return loss, jitter, rtt
+}
+
+// updateSample turns counters into rates against the previous sample in last.
+// For a broadcaster loss comes from the counters; a viewer's is already a fraction.
+func (m *MediaState) updateSample(last *qualitySample, cur qualitySample, countLoss bool) qualitySample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := *last
+	if !prev.at.IsZero() && cur.at.Sub(prev.at) < minStatsInterval {
+		if !countLoss {
+			prev.loss = cur.loss
+		}
+		return prev
+	}
+
+	if countLoss {
+		received, lost := cur.received, cur.lost
+		if !prev.at.IsZero() && received >= prev.received && lost >= prev.lost {
+			received, lost = received-prev.received, lost-prev.lost
+		}
+		if received+lost > 0 {
+			cur.loss = float64(lost) / float64(received+lost)
+		}
+	}
+	if !prev.at.IsZero() {
+		secs := cur.at.Sub(prev.at).Seconds()
+		cur.bitrateIn = uint64(float64(counterDelta(cur.bytesIn, prev.bytesIn)*8) / secs)
+		cur.bitrateOut = uint64(float64(counterDelta(cur.bytesOut, prev.bytesOut)*8) / secs)
+		cur.fps = float64(counterDelta(cur.frames, prev.frames)) / secs
+		// Simulcast layers carry the same frames; report the active layer
+		// with the highest rate rather than their sum
+		for key, frames := range cur.layers {
+			before, ok := prev.layers[key]
+			if !ok {
+				continue // new layer, no baseline yet
+			}
+			if fps := float64(counterDelta(frames, before)) / secs; fps > cur.fps {
+				cur.fps = fps
+			}
+		}
+	}
+	*last = cur
+	return cur
+}
+
+// Counters restart when tracks are replaced; treat that as a fresh start
+func counterDelta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// Round trip from the LSR/DLSR fields of a report block, in 1/65536 s units
+func reportRTT(report rtcp.ReceptionReport, now time.Time) time.Duration {
+	if report.LastSenderReport == 0 {
+		return 0
+	}
+	secs := uint64(now.Unix() + 2208988800) // NTP epoch is 1900
+	frac := uint64(now.Nanosecond()) << 32 / uint64(time.Second)
+	mid := uint32((secs<<32 | frac) >> 16)
+
+	rtt := mid - report.LastSenderReport - report.Delay
+	if int32(rtt) <= 0 {
+		return 0
+	}
+	return time.Duration(rtt) * time.Second / 65536
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
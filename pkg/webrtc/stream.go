@@ -1,25 +1,33 @@
 package webrtc
 
 import (
+	"context"
 	"encoding/json"
-	"log"
-	"os"
-	"sync"
+	"strings"
 
 	"github.com/gofiber/websocket/v2"
 	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"webrtc-streaming/pkg/logging"
+	"webrtc-streaming/pkg/signaling"
 )
 
 // Handles a viewer (helper) WebSocket
-func StreamConn(c *websocket.Conn, p *Peers, room *Room) {
-	config := webrtc.Configuration{}
-	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
-		config = turnConfig
-	}
+func StreamConn(ctx context.Context, c *websocket.Conn, p *Peers, room *Room) {
+	id := newPeerID("viewer")
+	ws := NewWriter(c)
+	logger := logging.FromContext(ctx).WithFields(logrus.Fields{
+		logging.RoomID: room.ID,
+		logging.Role:   "viewer",
+		logging.ConnID: id,
+	})
 
-	pc, err := webrtc.NewPeerConnection(config)
+	pc, err := newPeerConnection(rtcConfiguration())
 	if err != nil {
-		log.Println("Viewer PeerConnection creation failed:", err)
+		logger.WithError(err).Error("Viewer PeerConnection creation failed")
+		ws.Fail(signaling.NewError(signaling.CodeInternal, "", "could not create a PeerConnection"), signaling.CloseInternal)
 		return
 	}
 	defer pc.Close()
@@ -29,69 +37,105 @@ func StreamConn(c *websocket.Conn, p *Peers, room *Room) {
 		if _, err := pc.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
 			Direction: webrtc.RTPTransceiverDirectionRecvonly,
 		}); err != nil {
-			log.Println("AddTransceiver error:", err)
+			logger.WithError(err).Error("AddTransceiver error")
+			ws.Fail(signaling.NewError(signaling.CodeInternal, "", "could not set up media"), signaling.CloseInternal)
 			return
 		}
 	}
 
 	newPeer := PeerConnectionState{
+		ID:             id,
 		PeerConnection: pc,
-		Websocket: &ThreadSafeWriter{
-			Conn:  c,
-			Mutex: sync.Mutex{},
-		},
-		Role: "viewer",
+		Websocket:      ws,
+		Role:           "viewer",
+		Name:           c.Query("name"),
+		Media:          newMediaState(),
+		Log:            logger,
 	}
 
+	span := startPeerSpan(ctx, newPeer)
+	defer span.End()
+
 	// Register viewer
 	p.ListLock.Lock()
 	p.Connections = append(p.Connections, newPeer)
 	p.ListLock.Unlock()
-	log.Printf("New viewer connected. Total peers: %d", len(p.Connections))
+	logger.WithField("peers", len(p.Connections)).Info("Viewer connected")
+	p.join(newPeer)
+	defer p.leave(newPeer)
 
 	// Send ICE to viewer as JSON
 	pc.OnICECandidate(func(i *webrtc.ICECandidate) {
 		if i == nil {
+			_ = ws.Send(websocketMessage{Event: "end-of-candidates"})
 			return
 		}
 		candJSON, err := json.Marshal(i.ToJSON())
 		if err != nil {
-			log.Println("ICE candidate marshal error:", err)
+			logger.WithError(err).Error("ICE candidate marshal error")
 			return
 		}
-		if err := newPeer.Websocket.WriteJSON(&websocketMessage{
+		if err := ws.Send(websocketMessage{
 			Event: "candidate",
 			Data:  string(candJSON),
 		}); err != nil {
-			log.Println("Send candidate error:", err)
+			logger.WithError(err).Error("Send candidate error")
 		}
 	})
 
+	// The server is the offerer here, so it restarts ICE itself
+	restarts := newICERestarter()
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		log.Printf("Viewer PC state: %s", state.String())
-		switch state {
-		case webrtc.PeerConnectionStateFailed:
-			_ = pc.Close()
-		case webrtc.PeerConnectionStateClosed:
+		logger.WithField("state", state.String()).Info("Viewer PC state changed")
+		pcStateTransitions.WithLabelValues("viewer", state.String()).Inc()
+		span.AddEvent("connection state", trace.WithAttributes(attribute.String("state", state.String())))
+		if state == webrtc.PeerConnectionStateClosed {
 			p.SignalPeerConnections(room)
+			return
+		}
+		restart, attempt, giveUp := restarts.onState(state)
+		if restart {
+			logger.WithField("attempt", attempt).Warn("Restarting viewer ICE")
+			iceRestarts.WithLabelValues("viewer", "server").Inc()
+			if err := p.restartViewerICE(newPeer); err != nil {
+				logger.WithError(err).Error("ICE restart offer error")
+			}
+		}
+		if giveUp {
+			logger.WithField("attempts", attempt).Warn("ICE restarts exhausted; closing viewer")
+			_ = pc.Close()
+			// The client's close reply ends the read loop
+			ws.Fail(signaling.NewError(signaling.CodeICEFailed, "", "ICE failed after %d restarts", attempt), signaling.CloseInternal)
 		}
 	})
 
 	// Sync tracks and send OFFER to viewer
 	p.SignalPeerConnections(room)
 
-	// Handle incoming WS messages
+	// Handle incoming WS messages; a client that stops answering pings is
+	// dropped and the broadcaster told
+	hb := StartHeartbeat(c)
+	defer hb.Stop()
+	var candidates candidateQueue
 	for {
 		_, raw, err := c.ReadMessage()
 		if err != nil {
-			log.Println("Viewer WS read error:", err)
+			if HeartbeatMissed(err, "viewer") {
+				logger.Warn("Viewer missed heartbeat; disconnecting")
+				_ = ws.Close(signaling.CloseGoingAway, "heartbeat missed")
+				p.BroadcastTo("broadcaster", "peer-disconnected", "viewer")
+				return
+			}
+			logger.WithError(err).Info("Viewer WS closed")
 			return
 		}
+		hb.Alive()
 
-		var msg websocketMessage
-		if err := json.Unmarshal(raw, &msg); err != nil {
-			log.Println("Viewer WS unmarshal error:", err)
-			return
+		msg, verr := ws.Codec.Decode(raw)
+		if verr != nil {
+			logger.WithError(verr).Warn("Rejected viewer message")
+			_ = ws.Send(verr.Event())
+			continue
 		}
 
 		switch msg.Event {
@@ -100,26 +144,119 @@ func StreamConn(c *websocket.Conn, p *Peers, room *Room) {
 			if err := json.Unmarshal([]byte(msg.Data), &candInit); err != nil {
 				candInit = webrtc.ICECandidateInit{Candidate: msg.Data}
 			}
-			if err := pc.AddICECandidate(candInit); err != nil {
-				log.Println("AddICECandidate error:", err)
-				return
+			queued, err := candidates.add(pc, candInit)
+			traceSignal(span, msg.Event, err)
+			if err != nil {
+				logger.WithError(err).Warn("AddICECandidate error")
+				_ = ws.Send(candidateError(err).Event())
+				continue
+			}
+			if queued {
+				logger.Debug("Candidate held until the answer arrives")
 			}
 
 		case "answer":
 			// Android viewer sends plain SDP
+			if ok, codecs := p.viewerCodecsCompatible(msg.Data); !ok {
+				logger.WithField("codecs", strings.Join(codecs, ",")).Warn("Viewer shares no video codec with broadcaster")
+				span.AddEvent("codec-unsupported", trace.WithAttributes(attribute.String("codecs", strings.Join(codecs, ","))))
+				if err := ws.Send(websocketMessage{
+					Event: "codec-unsupported",
+					Data:  strings.Join(codecs, ","),
+				}); err != nil {
+					logger.WithError(err).Error("Send codec-unsupported error")
+				}
+				if codecPolicy().RejectIncompatibleViewers {
+					_ = pc.Close()
+					ws.Fail(signaling.NewError(signaling.CodeUnsupportedCodec, msg.Event, "no common video codec"), signaling.CloseUnsupported)
+					return
+				}
+				// Keep the viewer on audio only; drop video senders before the
+				// answer is applied so binding the unsupported codec cannot fail
+				newPeer.Media.DisableVideo()
+				for _, sender := range pc.GetSenders() {
+					if sender.Track() != nil && sender.Track().Kind() == webrtc.RTPCodecTypeVideo {
+						if err := pc.RemoveTrack(sender); err != nil {
+							logger.WithError(err).Error("RemoveTrack error")
+						}
+					}
+				}
+			}
 			answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: msg.Data}
-			if err := pc.SetRemoteDescription(answer); err != nil {
-				log.Println("SetRemoteDescription(answer) error:", err)
-				return
+			err := pc.SetRemoteDescription(answer)
+			traceSignal(span, msg.Event, err)
+			if err != nil {
+				// The offer is still pending, so the client may answer again
+				logger.WithError(err).Warn("SetRemoteDescription(answer) error")
+				_ = ws.Send(signaling.NewError(signaling.CodeInvalidSDP, msg.Event, "%v", err).Event())
+				continue
+			}
+			if n, err := candidates.flush(pc); err != nil {
+				logger.WithError(err).Warn("Early candidate rejected")
+			} else if n > 0 {
+				logger.WithField("candidates", n).Debug("Applied early candidates")
+			}
+			p.ApplyLayer(newPeer)
+
+		case "select-layer":
+			// "q", "h", "f" or "auto"
+			if !newPeer.Media.SetLayer(msg.Data) {
+				logger.WithField("value", msg.Data).Warn("Invalid simulcast layer from viewer")
+				continue
+			}
+			if err := ws.Send(websocketMessage{
+				Event: "layer",
+				Data:  p.ApplyLayer(newPeer),
+			}); err != nil {
+				logger.WithError(err).Error("Send layer error")
+			}
+
+		case "audio-only":
+			enabled, ok := parseAudioOnly(msg.Data)
+			if !ok {
+				logger.WithField("value", msg.Data).Warn("Invalid audio-only value from viewer")
+				continue
+			}
+			room.SetAudioOnly(enabled, AudioOnlyByViewer)
+
+		case "ice-restart":
+			// The viewer noticed a network change; answer with a restart offer
+			iceRestarts.WithLabelValues("viewer", "client").Inc()
+			err := p.restartViewerICE(newPeer)
+			traceSignal(span, msg.Event, err)
+			if err != nil {
+				logger.WithError(err).Error("ICE restart offer error")
 			}
 
 		case "duress-stop":
-			log.Println("Viewer requested duress termination")
+			logger.Info("Viewer requested duress termination")
 			_ = pc.Close()
+			_ = ws.Close(signaling.CloseNormal, "duress stopped")
 			return
 
+		case "end-of-candidates":
+			logger.Debug("Viewer finished gathering candidates")
+
+		case "bye":
+			logger.WithField("reason", msg.Data).Info("Viewer said bye")
+			_ = pc.Close()
+			_ = ws.Close(signaling.CloseNormal, "bye")
+			return
+
+		case "error":
+			logger.WithField("error", msg.Data).Warn("Viewer reported an error")
+
+		case "heartbeat":
+			// Application-level keepalive for clients that cannot see pings
+			if err := ws.Send(websocketMessage{
+				Event: "heartbeat-ack",
+				Data:  msg.Data,
+			}); err != nil {
+				logger.WithError(err).Error("Send heartbeat-ack error")
+			}
+
 		default:
-			log.Println("Unknown event from viewer:", msg.Event)
+			logger.WithField("event", msg.Event).Warn("Unknown event from viewer")
 		}
 	}
 }
@@ -0,0 +1,30 @@
+package webrtc
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("webrtc-streaming/pkg/webrtc")
+
+// Span covering one peer's connection, a child of whatever ctx carries
+func startPeerSpan(ctx context.Context, peer PeerConnectionState) trace.Span {
+	_, span := tracer.Start(ctx, "webrtc "+peer.Role, trace.WithAttributes(
+		attribute.String("peer.id", peer.ID),
+		attribute.String("peer.role", peer.Role),
+	))
+	return span
+}
+
+// Record a signaling message handled for the peer; err marks the span failed
+func traceSignal(span trace.Span, event string, err error) {
+	span.AddEvent("signal", trace.WithAttributes(attribute.String("event", event)))
+	if err != nil {
+		span.RecordError(err, trace.WithAttributes(attribute.String("event", event)))
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,362 @@
+package webrtc
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// ForwardTrack is a TrackLocal fed by one broadcaster track. A simulcast track
+// has one layer per RID, a plain track a single layer keyed "". Each viewer
+// binding forwards exactly one layer through its own rewriter, so viewers can
+// receive different layers and switch between them, or survive the broadcaster
+// track being replaced, without a discontinuity. Lost packets are resent from
+// the layer's buffer when a viewer NACKs them.
+type ForwardTrack struct {
+	mu           sync.RWMutex
+	id, streamID string
+	kind         webrtc.RTPCodecType
+	codec        webrtc.RTPCodecCapability
+	layers       map[string]*trackLayer
+	bindings     map[webrtc.SSRC]*trackBinding
+	metrics      trackMetrics
+}
+
+type trackLayer struct {
+	remote *webrtc.TrackRemote
+	source *webrtc.PeerConnection // broadcaster connection the stream arrives on
+	buffer *packetBuffer
+	frames uint64
+}
+
+type trackBinding struct {
+	id          string
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	writeStream webrtc.TrackLocalWriter
+	layer       string // layer currently forwarded, if active
+	active      bool
+	pending     string // layer to switch to on its next keyframe, if switching
+	switching   bool
+	rewriter    rtpRewriter
+	frames      uint64 // video frames written to the viewer
+}
+
+func newForwardTrack(t *webrtc.TrackRemote, roomID string) *ForwardTrack {
+	return &ForwardTrack{
+		id:       t.ID(),
+		streamID: t.StreamID(),
+		kind:     t.Kind(),
+		codec:    t.Codec().RTPCodecCapability,
+		layers:   map[string]*trackLayer{},
+		bindings: map[webrtc.SSRC]*trackBinding{},
+		metrics:  newTrackMetrics(roomID, t.ID(), t.Kind()),
+	}
+}
+
+// Bind starts a viewer on the best layer currently received, from its next keyframe
+func (s *ForwardTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, codec := range ctx.CodecParameters() {
+		if strings.EqualFold(codec.MimeType, s.codec.MimeType) {
+			b := &trackBinding{
+				id:          ctx.ID(),
+				ssrc:        ctx.SSRC(),
+				payloadType: codec.PayloadType,
+				writeStream: ctx.WriteStream(),
+				rewriter:    rtpRewriter{clockRate: s.codec.ClockRate},
+			}
+			b.switchTo(s.nearestLayer("f"))
+			s.bindings[ctx.SSRC()] = b
+			go s.requestKeyFrame(b.pending)
+			return codec, nil
+		}
+	}
+	return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+}
+
+func (s *ForwardTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ssrc, b := range s.bindings {
+		if b.id == ctx.ID() {
+			delete(s.bindings, ssrc)
+			return nil
+		}
+	}
+	return webrtc.ErrUnbindFailed
+}
+
+func (s *ForwardTrack) ID() string       { return s.id }
+func (s *ForwardTrack) StreamID() string { return s.streamID }
+
+func (s *ForwardTrack) Kind() webrtc.RTPCodecType { return s.kind }
+
+func (s *ForwardTrack) Codec() webrtc.RTPCodecCapability { return s.codec }
+
+// Simulcast reports whether the track is received as RID layers
+func (s *ForwardTrack) Simulcast() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, plain := s.layers[""]
+	return len(s.layers) > 0 && !plain
+}
+
+// Layers returns the RIDs currently received from the broadcaster
+func (s *ForwardTrack) Layers() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	layers := []string{}
+	for _, rid := range simulcastLayers {
+		if _, ok := s.layers[rid]; ok {
+			layers = append(layers, rid)
+		}
+	}
+	return layers
+}
+
+// SelectLayer moves the viewer bound with ssrc to another simulcast layer. The
+// switch happens on the layer's next keyframe; one is requested right away.
+func (s *ForwardTrack) SelectLayer(ssrc webrtc.SSRC, rid string) string {
+	s.mu.Lock()
+	b, ok := s.bindings[ssrc]
+	if _, plain := s.layers[""]; !ok || plain || len(s.layers) == 0 {
+		s.mu.Unlock()
+		return ""
+	}
+	rid = s.nearestLayer(rid)
+	if b.active && rid == b.layer {
+		b.pending, b.switching = "", false
+		s.mu.Unlock()
+		return rid
+	}
+	b.switchTo(rid)
+	s.mu.Unlock()
+
+	s.requestKeyFrame(rid)
+	return rid
+}
+
+// WriteRTP forwards a packet of layer rid to every viewer bound to that layer
+func (s *ForwardTrack) WriteRTP(rid string, pkt *rtp.Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	layer, ok := s.layers[rid]
+	if !ok || !layer.buffer.Push(pkt) {
+		return nil
+	}
+	s.metrics.packets.Inc()
+	s.metrics.bytes.Add(float64(len(pkt.Payload)))
+	endOfFrame := s.kind == webrtc.RTPCodecTypeVideo && pkt.Marker
+	if endOfFrame {
+		layer.frames++
+	}
+
+	keyFrame := false
+	checked := false
+	var lastErr error
+	for _, b := range s.bindings {
+		if b.switching && b.pending == rid {
+			if !checked {
+				keyFrame = isKeyFrame(s.codec.MimeType, pkt.Payload)
+				checked = true
+			}
+			if keyFrame {
+				if b.active {
+					b.rewriter.Resync()
+				}
+				b.layer, b.active = rid, true
+				b.pending, b.switching = "", false
+			}
+		}
+		if !b.active || b.layer != rid {
+			continue
+		}
+
+		header := pkt.Header
+		b.rewriter.Rewrite(&header)
+		if _, err := b.write(&header, pkt.Payload); err != nil {
+			lastErr = err
+		} else if endOfFrame {
+			b.frames++
+		}
+	}
+	return lastErr
+}
+
+// Retransmit answers a viewer's NACK from the buffer of the layer it receives
+func (s *ForwardTrack) Retransmit(ssrc webrtc.SSRC, seqs []uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.bindings[ssrc]
+	if !ok || !b.active {
+		return
+	}
+	layer, ok := s.layers[b.layer]
+	if !ok {
+		return
+	}
+	for _, seq := range seqs {
+		src, ok := b.rewriter.Source(seq)
+		if !ok {
+			continue
+		}
+		pkt := layer.buffer.Get(src)
+		if pkt == nil {
+			continue
+		}
+		header := pkt.Header
+		header.SequenceNumber = seq
+		header.Timestamp += b.rewriter.tsOffset
+		_, _ = b.write(&header, pkt.Payload)
+	}
+}
+
+func (b *trackBinding) write(header *rtp.Header, payload []byte) (int, error) {
+	header.SSRC = uint32(b.ssrc)
+	header.PayloadType = uint8(b.payloadType)
+	return b.writeStream.WriteRTP(header, payload)
+}
+
+func (b *trackBinding) switchTo(rid string) {
+	b.pending, b.switching = rid, true
+}
+
+// Layer the binding is on or heading to
+func (b *trackBinding) target() string {
+	if b.switching {
+		return b.pending
+	}
+	return b.layer
+}
+
+// addLayer attaches a broadcaster stream. A layer that already existed was
+// replaced by the broadcaster, so its viewers resync on the new stream.
+func (s *ForwardTrack) addLayer(t *webrtc.TrackRemote, source *webrtc.PeerConnection) {
+	rid := t.RID()
+
+	s.mu.Lock()
+	for _, b := range s.bindings {
+		if b.active && b.layer == rid {
+			// Stop forwarding until the new stream's keyframe, then continue seamlessly
+			b.active = false
+			b.rewriter.Resync()
+			b.switchTo(rid)
+		} else if _, ok := s.layers[b.target()]; !ok {
+			b.switchTo(rid)
+		}
+	}
+	s.layers[rid] = &trackLayer{remote: t, source: source, buffer: &packetBuffer{clockRate: s.codec.ClockRate}}
+	s.mu.Unlock()
+
+	s.requestKeyFrame(rid)
+}
+
+// removeLayer drops a layer and reports whether any are left
+func (s *ForwardTrack) removeLayer(rid string, remote *webrtc.TrackRemote) bool {
+	s.mu.Lock()
+	// A replacement stream may already have taken over this layer
+	if layer, ok := s.layers[rid]; ok && layer.remote == remote {
+		delete(s.layers, rid)
+	}
+	remaining := len(s.layers)
+	fallback := s.nearestLayer(rid)
+	for _, b := range s.bindings {
+		if _, ok := s.layers[b.target()]; !ok && fallback != "" {
+			b.switchTo(fallback)
+		}
+	}
+	s.mu.Unlock()
+
+	if fallback != "" {
+		s.requestKeyFrame(fallback)
+	}
+	return remaining > 0
+}
+
+// Closest received layer at or below rid, else the lowest one above it.
+// A plain track only has the "" layer. Callers must hold s.mu.
+func (s *ForwardTrack) nearestLayer(rid string) string {
+	if _, ok := s.layers[""]; ok {
+		return ""
+	}
+	idx := layerIndex(rid)
+	for i := idx; i >= 0; i-- {
+		if _, ok := s.layers[simulcastLayers[i]]; ok {
+			return simulcastLayers[i]
+		}
+	}
+	for i := idx + 1; i < len(simulcastLayers); i++ {
+		if _, ok := s.layers[simulcastLayers[i]]; ok {
+			return simulcastLayers[i]
+		}
+	}
+	return ""
+}
+
+func (s *ForwardTrack) requestKeyFrame(rid string) {
+	if s.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	s.mu.RLock()
+	layer, ok := s.layers[rid]
+	s.mu.RUnlock()
+	if !ok || layer.source == nil {
+		return
+	}
+	_ = layer.source.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(layer.remote.SSRC())},
+	})
+}
+
+// Counters for the streams one broadcaster connection feeds into a track
+type streamStats struct {
+	Received uint64
+	Lost     uint64
+	Frames   map[string]uint64 // by simulcast RID
+	Jitter   time.Duration
+}
+
+// sourceStats sums the layers received from source; frames are kept per layer
+// and jitter is the worst layer's
+func (s *ForwardTrack) sourceStats(source *webrtc.PeerConnection) (streamStats, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	st := streamStats{Frames: make(map[string]uint64)}
+	found := false
+	for rid, layer := range s.layers {
+		if layer.source != source {
+			continue
+		}
+		found = true
+		received, lost := layer.buffer.Counts()
+		st.Received += received
+		st.Lost += lost
+		st.Frames[rid] = layer.frames
+		if j := layer.buffer.Jitter(); j > st.Jitter {
+			st.Jitter = j
+		}
+	}
+	return st, found
+}
+
+// framesSent returns the video frames forwarded to the viewer bound with ssrc
+func (s *ForwardTrack) framesSent(ssrc webrtc.SSRC) uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if b, ok := s.bindings[ssrc]; ok {
+		return b.frames
+	}
+	return 0
+}
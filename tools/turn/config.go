@@ -0,0 +1,170 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+
+    "gopkg.in/yaml.v3"
+    "webrtc-streaming/pkg/turnserver"
+)
+
+// config is everything the TURN tool runs with: defaults, then the YAML file
+// from --config, then any command-line flags that were set explicitly
+type config struct {
+    turnserver.Config `yaml:",inline"`
+    Log               logConfig `yaml:"log"`
+    MetricsAddr       string    `yaml:"metricsAddr"`
+}
+
+type logConfig struct {
+    Format string `yaml:"format"` // json or logfmt
+    Level  string `yaml:"level"`
+    Redact bool   `yaml:"redact"` // mask secrets in log lines
+}
+
+// Command-line flags; each overrides the config file when set
+var (
+    configFile       = flag.String("config", os.Getenv("TURN_CONFIG"), "YAML config file (default $TURN_CONFIG); reloaded on SIGHUP")
+    publicIP         = flag.String("public-ip", "", "Public IP address of the TURN server")
+    port             = flag.Int("port", 3478, "Port to listen on (default 3478)")
+    tcp              = flag.Bool("tcp", true, "Also accept TURN over TCP on --port")
+    tlsPort          = flag.Int("tls-port", 5349, "Port for TURN over TLS, used when --cert and --key are set")
+    certFile         = flag.String("cert", "", "TLS certificate (PEM); reloaded when the file changes")
+    keyFile          = flag.String("key", "", "TLS private key (PEM)")
+    userAllocations  = flag.Int("user-allocations", 10, "Concurrent allocations per user (0 = unlimited)")
+    totalAllocations = flag.Int("total-allocations", 4000, "Concurrent allocations on the server (0 = unlimited)")
+    userKbps         = flag.Int64("user-kbps", 0, "Relayed bitrate per user in kbit/s, both directions (0 = unlimited)")
+    totalKbps        = flag.Int64("total-kbps", 0, "Relayed bitrate on the server in kbit/s (0 = unlimited)")
+    allowPeers       = flag.String("allow-peers", "", "Comma-separated CIDRs clients may relay to even if denied")
+    denyPeers        = flag.String("deny-peers", strings.Join(turnserver.DefaultDeniedPeers, ","), "Comma-separated CIDRs clients may not relay to")
+    users            = flag.String("users", "", "Comma-separated list of user=pass credentials")
+    realm            = flag.String("realm", "v.akhil.sh", "Authentication realm")
+    secret           = flag.String("auth-secret", os.Getenv("TURN_SECRET"), "Shared secret for time-limited credentials (default $TURN_SECRET)")
+    metricsAddr      = flag.String("metrics-addr", "", "Serve Prometheus /metrics on this address, e.g. :9641 (empty disables)")
+)
+
+func defaultConfig() *config {
+    return &config{
+        Config: turnserver.Config{
+            Realm:     *realm,
+            TLS:       turnserver.TLS{CertFile: *certFile, KeyFile: *keyFile},
+            PortRange: turnserver.PortRange{Min: 50000, Max: 55000},
+            Auth:      turnserver.Auth{Secret: *secret, Users: parseUsers(*users)},
+            Limits: turnserver.Limits{
+                UserAllocations:  *userAllocations,
+                TotalAllocations: *totalAllocations,
+                UserKbps:         *userKbps,
+                TotalKbps:        *totalKbps,
+            },
+            Peers: turnserver.Peers{
+                Allow: splitList(*allowPeers),
+                Deny:  splitList(*denyPeers),
+            },
+        },
+        Log: logConfig{
+            Format: os.Getenv("LOG_FORMAT"),
+            Level:  os.Getenv("LOG_LEVEL"),
+            Redact: true,
+        },
+        MetricsAddr: *metricsAddr,
+    }
+}
+
+// loadConfig builds the configuration from the file named by --config, if
+// any, and the flags. It is called again on SIGHUP.
+func loadConfig() (*config, error) {
+    cfg := defaultConfig()
+    if v := os.Getenv("LOG_REDACT"); v != "" {
+        redact, err := strconv.ParseBool(v)
+        if err != nil {
+            return nil, fmt.Errorf("invalid LOG_REDACT %q", v)
+        }
+        cfg.Log.Redact = redact
+    }
+    if *configFile != "" {
+        data, err := os.ReadFile(*configFile)
+        if err != nil {
+            return nil, fmt.Errorf("read config: %v", err)
+        }
+        if err := yaml.Unmarshal(data, cfg); err != nil {
+            return nil, fmt.Errorf("parse %s: %v", *configFile, err)
+        }
+    }
+    cfg.applyFlags()
+    if err := cfg.Validate(); err != nil {
+        return nil, err
+    }
+    return cfg, nil
+}
+
+// Flags given on the command line win over the file
+func (c *config) applyFlags() {
+    listenFlags := false
+    flag.Visit(func(f *flag.Flag) {
+        switch f.Name {
+        case "public-ip":
+            c.Relays = []turnserver.Relay{{PublicIP: *publicIP}}
+        case "port", "tcp", "tls-port":
+            listenFlags = true
+        case "cert", "key":
+            c.TLS = turnserver.TLS{CertFile: *certFile, KeyFile: *keyFile}
+        case "user-allocations":
+            c.Limits.UserAllocations = *userAllocations
+        case "total-allocations":
+            c.Limits.TotalAllocations = *totalAllocations
+        case "user-kbps":
+            c.Limits.UserKbps = *userKbps
+        case "total-kbps":
+            c.Limits.TotalKbps = *totalKbps
+        case "allow-peers":
+            c.Peers.Allow = splitList(*allowPeers)
+        case "deny-peers":
+            c.Peers.Deny = splitList(*denyPeers)
+        case "users":
+            c.Auth.Users = parseUsers(*users)
+        case "realm":
+            c.Realm = *realm
+        case "auth-secret":
+            c.Auth.Secret = *secret
+        case "metrics-addr":
+            c.MetricsAddr = *metricsAddr
+        }
+    })
+
+    // Without a listen list, or when the port flags are given, listen on all
+    // IPv4 addresses as the tool always has
+    if len(c.Listen) == 0 || listenFlags {
+        addr := "0.0.0.0:" + strconv.Itoa(*port)
+        c.Listen = []turnserver.Listen{{Address: addr, Protocol: "udp"}}
+        if *tcp {
+            c.Listen = append(c.Listen, turnserver.Listen{Address: addr, Protocol: "tcp"})
+        }
+        if c.TLS.CertFile != "" {
+            c.Listen = append(c.Listen, turnserver.Listen{Address: "0.0.0.0:" + strconv.Itoa(*tlsPort), Protocol: "tls"})
+        }
+    }
+}
+
+func splitList(s string) []string {
+    var items []string
+    for _, item := range strings.Split(s, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+// Parses user credentials from flag input
+func parseUsers(input string) map[string]string {
+    users := make(map[string]string)
+    re := regexp.MustCompile(`(\w+)=(\w+)`)
+    for _, match := range re.FindAllStringSubmatch(input, -1) {
+        users[match[1]] = match[2]
+    }
+    return users
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+    "net/http"
+
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "webrtc-streaming/pkg/logging"
+)
+
+// Serve /metrics on the side port until the process exits
+func serveMetrics(addr string) {
+    mux := http.NewServeMux()
+    mux.Handle("/metrics", promhttp.Handler())
+    logging.Logger.WithField("addr", addr).Info("TURN metrics listening")
+    if err := http.ListenAndServe(addr, mux); err != nil {
+        logging.Logger.WithError(err).Error("TURN metrics server stopped")
+    }
+}
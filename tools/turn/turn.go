@@ -3,89 +3,65 @@ package main
 import (
     "flag"
     "log"
-    "net"
     "os"
     "os/signal"
-    "regexp"
-    "strconv"
     "syscall"
 
-    "github.com/pion/turn/v2"
+    "webrtc-streaming/pkg/logging"
+    "webrtc-streaming/pkg/turnserver"
 )
 
 func main() {
-    // Parse command-line flags
-    publicIP := flag.String("public-ip", "", "Public IP address of the TURN server")
-    port := flag.Int("port", 3478, "Port to listen on (default 3478)")
-    users := flag.String("users", "", "Comma-separated list of user=pass credentials")
-    realm := flag.String("realm", "v.akhil.sh", "Authentication realm")
+    // Parse command-line flags (see config.go)
     flag.Parse()
 
-    // Validate input
-    if ip := net.ParseIP(*publicIP); ip == nil {
-        log.Fatalf("Valid --public-ip is required")
+    cfg, err := loadConfig()
+    if err != nil {
+        log.Fatalf("Invalid TURN config: %v", err)
     }
-    if len(*users) == 0 {
-        log.Fatalf("--users is required (format: user=pass,user=pass)")
+    if err := logging.Apply(cfg.Log.Format, cfg.Log.Level, cfg.Log.Redact); err != nil {
+        log.Fatalf("Invalid logging config: %v", err)
     }
+    logger := logging.Logger
 
-    // Create UDP listener
-    addr := "0.0.0.0:" + strconv.Itoa(*port)
-    udpListener, err := net.ListenPacket("udp4", addr)
-    if err != nil {
-        log.Panicf("Failed to create TURN server listener: %v", err)
+    if cfg.MetricsAddr != "" {
+        go serveMetrics(cfg.MetricsAddr)
     }
 
-    // Parse user credentials
-    usersMap := parseUsers(*users, *realm)
-
     // Start TURN server
-    server, err := turn.NewServer(turn.ServerConfig{
-        Realm: *realm,
-        AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
-            key, ok := usersMap[username]
-            return key, ok
-        },
-        PacketConnConfigs: []turn.PacketConnConfig{
-            {
-                PacketConn: udpListener,
-                RelayAddressGenerator: &turn.RelayAddressGeneratorPortRange{
-                    RelayAddress: net.ParseIP(*publicIP),
-                    Address:      "0.0.0.0",
-                    MinPort:      50000,
-                    MaxPort:      55000,
-                },
-            },
-        },
-    })
+    server, err := turnserver.Start(cfg.Config)
     if err != nil {
-        log.Panicf("Failed to start TURN server: %v", err)
+        logger.Fatalf("Failed to start TURN server: %v", err)
     }
 
-    log.Printf("TURN server started on %s:%d with realm '%s'", *publicIP, *port, *realm)
+    // SIGHUP reloads users and limits; existing allocations are kept
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+    for sig := range sigs {
+        if sig != syscall.SIGHUP {
+            break
+        }
+        next, err := loadConfig()
+        if err != nil {
+            logger.WithError(err).Error("TURN config reload failed; keeping the running config")
+            continue
+        }
+        restart, err := server.Reload(next.Config)
+        if err != nil {
+            logger.WithError(err).Error("TURN config reload failed; keeping the running config")
+            continue
+        }
+        if err := logging.Apply(next.Log.Format, next.Log.Level, cfg.Log.Redact); err != nil {
+            logger.WithError(err).Warn("Logging config not reloaded")
+        }
+        if restart || next.MetricsAddr != cfg.MetricsAddr {
+            logger.Warn("Realm, listen, relay, port range, TLS and metrics changes need a restart")
+        }
+        logger.WithField("users", len(next.Auth.Users)).Info("TURN config reloaded")
+    }
 
     // Graceful shutdown
-    waitForShutdown()
     if err := server.Close(); err != nil {
-        log.Panicf("Failed to shut down TURN server: %v", err)
-    }
-}
-
-// Parses user credentials from flag input
-func parseUsers(input, realm string) map[string][]byte {
-    usersMap := make(map[string][]byte)
-    re := regexp.MustCompile(`(\w+)=(\w+)`)
-    for _, match := range re.FindAllStringSubmatch(input, -1) {
-        username, password := match[1], match[2]
-        usersMap[username] = turn.GenerateAuthKey(username, realm, password)
+        logger.Panicf("Failed to shut down TURN server: %v", err)
     }
-    return usersMap
-}
-
-// Waits for termination signal
-func waitForShutdown() {
-    sigs := make(chan os.Signal, 1)
-    signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-    <-sigs
 }
-